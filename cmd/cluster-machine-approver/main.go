@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
 
-	"github.com/fraima/cluster-machine-approver/internal/cloud/yandex"
+	"github.com/fraima/cluster-machine-approver/internal/cloud"
+	"github.com/fraima/cluster-machine-approver/internal/cloud/cache"
+	_ "github.com/fraima/cluster-machine-approver/internal/cloud/static"
+	_ "github.com/fraima/cluster-machine-approver/internal/cloud/yandex"
 	"github.com/fraima/cluster-machine-approver/internal/controller"
+	"github.com/fraima/cluster-machine-approver/internal/health"
 	"github.com/fraima/cluster-machine-approver/internal/k8s"
+	"github.com/fraima/cluster-machine-approver/internal/metrics"
 )
 
 var (
@@ -18,11 +27,46 @@ var (
 )
 
 type configuration struct {
-	KubeHost           string `envconfig:"KUBE_HOST" default:"kubernetes.default"`
-	KubeTokenFile      string `envconfig:"KUBE_TOKEN_FILE" default:"/run/secrets/kubernetes.io/serviceaccount/token"`
-	AIMJson            []byte `envconfig:"YANDEX_AIM_JSON" required:"true"`
-	FolderID           string `envconfig:"YANDEX_FOLDER_ID" required:"true"`
-	InstanceNameLayout string `envconfig:"INSTANCE_NAME_LAYOUT" default:"system:node:(.[^ ]*)"`
+	Kubeconfig         string            `envconfig:"KUBECONFIG"`
+	KubeHost           string            `envconfig:"KUBE_HOST"`
+	KubeTokenFile      string            `envconfig:"KUBE_TOKEN_FILE" default:"/run/secrets/kubernetes.io/serviceaccount/token"`
+	KubeCAFile         string            `envconfig:"KUBE_CA_FILE"`
+	KubeInsecure       bool              `envconfig:"KUBE_INSECURE"`
+	KubeResyncPeriod   time.Duration     `envconfig:"KUBE_RESYNC_PERIOD" default:"10m"`
+	CloudProvider      string            `envconfig:"CLOUD_PROVIDER" default:"yandex"`
+	CloudCacheTTL      time.Duration     `envconfig:"CLOUD_CACHE_TTL" default:"1m"`
+	CloudCacheNegTTL   time.Duration     `envconfig:"CLOUD_CACHE_NEGATIVE_TTL" default:"10s"`
+	InstanceNameLayout string            `envconfig:"INSTANCE_NAME_LAYOUT" default:"system:node:(.[^ ]*)"`
+	InstanceLookup     string            `envconfig:"INSTANCE_LOOKUP" default:"name"`
+	Signers            map[string]string `envconfig:"SIGNERS" default:"kubernetes.io/kubelet-serving:serving"`
+	NodeGroups         []string          `envconfig:"NODE_GROUPS" default:"system:nodes"`
+	BootstrapGroups    []string          `envconfig:"BOOTSTRAP_GROUPS" default:"system:bootstrappers"`
+	BootstrapMaxAge    time.Duration     `envconfig:"BOOTSTRAP_MAX_INSTANCE_AGE" default:"1h"`
+	KeyAlgorithms      []string          `envconfig:"KEY_ALGORITHMS" default:"RSA,ECDSA"`
+	MinRSAKeySize      int               `envconfig:"MIN_RSA_KEY_SIZE" default:"2048"`
+	MinECDSAKeySize    int               `envconfig:"MIN_ECDSA_KEY_SIZE" default:"256"`
+	DNSSuffixes        []string          `envconfig:"DNS_SUFFIXES"`
+	InstanceStates     []string          `envconfig:"INSTANCE_STATES" default:"RUNNING"`
+	InstanceSelector   string            `envconfig:"INSTANCE_SELECTOR"`
+	InstanceGroups     []string          `envconfig:"INSTANCE_GROUPS"`
+	DryRun             bool              `envconfig:"DRY_RUN"`
+	AuditLog           string            `envconfig:"AUDIT_LOG"`
+	Workers            int               `envconfig:"WORKERS" default:"4"`
+	RetryBaseDelay     time.Duration     `envconfig:"RETRY_BASE_DELAY" default:"1s"`
+	RetryMaxDelay      time.Duration     `envconfig:"RETRY_MAX_DELAY" default:"5m"`
+	MaxRetries         int               `envconfig:"MAX_RETRIES" default:"10"`
+
+	LeaderElect                 bool          `envconfig:"LEADER_ELECT" default:"true"`
+	LeaderElectionLeaseName     string        `envconfig:"LEADER_ELECTION_LEASE_NAME" default:"cluster-machine-approver"`
+	LeaderElectionLeaseDuration time.Duration `envconfig:"LEADER_ELECTION_LEASE_DURATION" default:"15s"`
+	LeaderElectionRenewDeadline time.Duration `envconfig:"LEADER_ELECTION_RENEW_DEADLINE" default:"10s"`
+	LeaderElectionRetryPeriod   time.Duration `envconfig:"LEADER_ELECTION_RETRY_PERIOD" default:"2s"`
+	PodName                     string        `envconfig:"POD_NAME"`
+	PodNamespace                string        `envconfig:"POD_NAMESPACE" default:"default"`
+
+	HTTPAddress        string        `envconfig:"HTTP_ADDRESS" default:":8080"`
+	ProcessingTimeout  time.Duration `envconfig:"PROCESSING_TIMEOUT" default:"2m"`
+	CloudFailureWindow time.Duration `envconfig:"CLOUD_FAILURE_WINDOW" default:"5m"`
 }
 
 func main() {
@@ -41,38 +85,154 @@ func main() {
 
 	zap.L().Debug("configuration", zap.Any("config", cfg), zap.String("version", Version))
 
-	k, err := k8s.Connect(
-		cfg.KubeHost,
-		cfg.KubeTokenFile,
-	)
+	checker := health.New()
+
+	k, err := k8s.Connect(k8s.Config{
+		Kubeconfig:   cfg.Kubeconfig,
+		Host:         cfg.KubeHost,
+		TokenFile:    cfg.KubeTokenFile,
+		CAFile:       cfg.KubeCAFile,
+		Insecure:     cfg.KubeInsecure,
+		ResyncPeriod: cfg.KubeResyncPeriod,
+		Health:       checker,
+	})
 	if err != nil {
 		zap.L().Fatal("connect k8s", zap.Error(err))
 	}
 
-	cloud, err := yandex.ConnectCloud(cfg.AIMJson, cfg.FolderID)
+	provider, err := cloud.New(cfg.CloudProvider)
 	if err != nil {
-		zap.L().Fatal("connect yandex cloude", zap.Error(err))
+		zap.L().Fatal("connect cloud", zap.String("provider", cfg.CloudProvider), zap.Error(err))
+	}
+	if len(cfg.InstanceGroups) > 0 && !cloud.ResolvesGroups(provider) {
+		// Every request would be retried forever as the groups of its instance are unknown.
+		zap.L().Fatal("INSTANCE_GROUPS is set, but the cloud provider does not resolve instance groups", zap.String("provider", cfg.CloudProvider))
+	}
+	provider = cache.New(provider, cfg.CloudCacheTTL, cfg.CloudCacheNegTTL)
+	// Deferred before the HTTP server shutdown, so it runs after it, once the controller has stopped.
+	defer provider.Stop()
+
+	var auditSink controller.AuditSink
+	switch cfg.AuditLog {
+	case "":
+	case "stdout":
+		auditSink = controller.NewStdoutAuditSink()
+	default:
+		auditSink, err = controller.NewFileAuditSink(cfg.AuditLog)
+		if err != nil {
+			zap.L().Fatal("open audit log", zap.Error(err))
+		}
 	}
 
-	ctrl, err := controller.New(k, cloud, cfg.InstanceNameLayout)
+	ctrl, err := controller.New(k, provider, controller.Config{
+		InstanceNameLayout:      cfg.InstanceNameLayout,
+		InstanceLookup:          controller.Lookup(cfg.InstanceLookup),
+		Signers:                 cfg.Signers,
+		NodeGroups:              cfg.NodeGroups,
+		BootstrapGroups:         cfg.BootstrapGroups,
+		BootstrapMaxInstanceAge: cfg.BootstrapMaxAge,
+		KeyAlgorithms:           cfg.KeyAlgorithms,
+		MinRSAKeySize:           cfg.MinRSAKeySize,
+		MinECDSAKeySize:         cfg.MinECDSAKeySize,
+		DNSSuffixes:             cfg.DNSSuffixes,
+		InstanceStates:          cfg.InstanceStates,
+		InstanceSelector:        cfg.InstanceSelector,
+		InstanceGroups:          cfg.InstanceGroups,
+		DryRun:                  cfg.DryRun,
+		AuditSink:               auditSink,
+		Health:                  checker,
+		Workers:                 cfg.Workers,
+		RetryBaseDelay:          cfg.RetryBaseDelay,
+		RetryMaxDelay:           cfg.RetryMaxDelay,
+		MaxRetries:              cfg.MaxRetries,
+	})
 	if err != nil {
 		zap.L().Fatal("init controller", zap.Error(err))
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	health.Register(mux, checker, cfg.ProcessingTimeout, cfg.CloudFailureWindow)
+	server := &http.Server{
+		Addr:              cfg.HTTPAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
 	go func() {
-		err := ctrl.Start()
-		if err != nil {
-			zap.L().Fatal("start controller", zap.Error(err))
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.L().Fatal("serve http", zap.Error(err))
 		}
 	}()
+	defer shutdownServer(server)
 
-	zap.L().Info("started")
+	start := func() {
+		if err := ctrl.Start(); err != nil {
+			zap.L().Fatal("start controller", zap.Error(err))
+		}
+	}
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
 
+	if !cfg.LeaderElect {
+		start()
+		zap.L().Info("started")
+
+		<-ch
+		ctrl.Stop()
+
+		zap.L().Info("goodbye")
+		return
+	}
+
+	if cfg.PodName == "" {
+		cfg.PodName, err = os.Hostname()
+		if err != nil {
+			zap.L().Fatal("get leader election identity", zap.Error(err))
+		}
+	}
+
+	electionCtx, cancelElection := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	go func() {
+		defer close(electionDone)
+		err := k.RunLeaderElection(electionCtx, k8s.LeaderElectionConfig{
+			Namespace:     cfg.PodNamespace,
+			LeaseName:     cfg.LeaderElectionLeaseName,
+			Identity:      cfg.PodName,
+			LeaseDuration: cfg.LeaderElectionLeaseDuration,
+			RenewDeadline: cfg.LeaderElectionRenewDeadline,
+			RetryPeriod:   cfg.LeaderElectionRetryPeriod,
+		}, start)
+		if err != nil {
+			zap.L().Fatal("leader election", zap.Error(err))
+		}
+	}()
+
+	zap.L().Info("started")
+
+	select {
+	case <-ch:
+	case <-electionDone:
+		// Another replica may already be leading, drop queued requests and let the pod restart.
+		ctrl.Abort()
+		zap.L().Fatal("leader election lost")
+	}
+
+	// Finish in-flight requests before releasing the lease to the next leader.
 	ctrl.Stop()
+	cancelElection()
+	<-electionDone
 
 	zap.L().Info("goodbye")
 }
+
+func shutdownServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		zap.L().Warn("shutdown http", zap.Error(err))
+	}
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/fraima/cluster-machine-approver/internal/cloud"
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+	"github.com/fraima/cluster-machine-approver/internal/metrics"
+)
+
+type entry struct {
+	instance *controller.Instance
+	err      error
+	expires  time.Time
+}
+
+type cache struct {
+	provider    cloud.Provider
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]entry
+	lastSweep time.Time
+
+	group singleflight.Group
+}
+
+// New wraps provider with a cache of found instances kept for positiveTTL and
+// of not found instances kept for negativeTTL. A zero TTL disables that kind of caching.
+// Concurrent lookups of the same instance share one provider call.
+// Other errors are never cached. Lookups that ask for fresh data bypass the cache and refresh it.
+func New(provider cloud.Provider, positiveTTL, negativeTTL time.Duration) cloud.Provider {
+	return &cache{
+		provider:    provider,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]entry),
+	}
+}
+
+func (s *cache) GetInstance(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	key := string(lookup) + "/" + value
+	fresh := controller.FreshData(ctx)
+	if !fresh {
+		if e, ok := s.load(key); ok {
+			metrics.CloudCacheRequests.WithLabelValues("hit").Inc()
+			return e.instance, e.err
+		}
+	}
+	metrics.CloudCacheRequests.WithLabelValues("miss").Inc()
+
+	// A fresh lookup must not join a call that may have started before the data changed.
+	call := key
+	if fresh {
+		call = "fresh/" + key
+	}
+	v, err, _ := s.group.Do(call, func() (interface{}, error) {
+		instance, err := s.provider.GetInstance(ctx, lookup, value)
+		s.store(key, instance, err)
+		return instance, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*controller.Instance), nil
+}
+
+func (s *cache) Stop() {
+	s.provider.Stop()
+}
+
+func (s *cache) load(key string) (entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(s.entries, key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (s *cache) store(key string, instance *controller.Instance, err error) {
+	var ttl time.Duration
+	switch {
+	case err == nil:
+		ttl = s.positiveTTL
+	case errors.Is(err, controller.ErrInstanceNotFound):
+		ttl = s.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	s.entries[key] = entry{
+		instance: instance,
+		err:      err,
+		expires:  now.Add(ttl),
+	}
+}
+
+// sweep drops expired entries, at most once per the longest TTL, so names that are never asked again do not pile up.
+func (s *cache) sweep(now time.Time) {
+	period := s.positiveTTL
+	if s.negativeTTL > period {
+		period = s.negativeTTL
+	}
+	if now.Sub(s.lastSweep) < period {
+		return
+	}
+	s.lastSweep = now
+
+	for name, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, name)
+		}
+	}
+}
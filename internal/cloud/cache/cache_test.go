@@ -0,0 +1,158 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/fraima/cluster-machine-approver/internal/cloud/cache"
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+type countingProvider struct {
+	instances map[string]*controller.Instance
+	err       error
+	calls     int32
+	release   chan struct{}
+}
+
+func (s *countingProvider) Stop() {}
+
+func (s *countingProvider) GetInstance(_ context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	instance, ok := s.instances[string(lookup)+" "+value]
+	if !ok {
+		return nil, fmt.Errorf("instance %s %q: %w", lookup, value, controller.ErrInstanceNotFound)
+	}
+	return instance, nil
+}
+
+func TestCache(t *testing.T) {
+	testInstance := &controller.Instance{
+		ID: "test-instance-id",
+		Addresses: []net.IP{
+			net.ParseIP("123.123.123.123"),
+		},
+	}
+	provider := &countingProvider{
+		instances: map[string]*controller.Instance{"name test-virtual-name": testInstance},
+	}
+	c := cache.New(provider, time.Hour, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		instance, err := c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+		require.NoError(t, err)
+		require.Equal(t, testInstance, instance)
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&provider.calls))
+
+	for i := 0; i < 3; i++ {
+		_, err := c.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+		require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	}
+	require.EqualValues(t, 2, atomic.LoadInt32(&provider.calls))
+
+	// Lookups of the same value by another attribute are cached separately.
+	_, err := c.GetInstance(context.Background(), controller.LookupID, "test-virtual-name")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	require.EqualValues(t, 3, atomic.LoadInt32(&provider.calls))
+}
+
+func TestCacheExpiration(t *testing.T) {
+	provider := &countingProvider{
+		instances: map[string]*controller.Instance{"name test-virtual-name": {ID: "test-instance-id"}},
+	}
+	c := cache.New(provider, 10*time.Millisecond, 0)
+
+	_, err := c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&provider.calls))
+
+	// Negative caching is disabled.
+	_, err = c.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	_, err = c.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	require.EqualValues(t, 4, atomic.LoadInt32(&provider.calls))
+}
+
+func TestCacheFreshData(t *testing.T) {
+	provider := &countingProvider{
+		instances: map[string]*controller.Instance{"name test-virtual-name": {ID: "test-instance-id", Status: "PROVISIONING"}},
+	}
+	c := cache.New(provider, time.Hour, time.Hour)
+
+	_, err := c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+
+	provider.instances["name test-virtual-name"] = &controller.Instance{ID: "test-instance-id", Status: "RUNNING"}
+	instance, err := c.GetInstance(controller.WithFreshData(context.Background()), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	require.Equal(t, "RUNNING", instance.Status)
+	require.EqualValues(t, 2, atomic.LoadInt32(&provider.calls))
+
+	// The fresh instance replaces the cached one.
+	instance, err = c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	require.Equal(t, "RUNNING", instance.Status)
+	require.EqualValues(t, 2, atomic.LoadInt32(&provider.calls))
+}
+
+func TestCacheSkipsErrors(t *testing.T) {
+	provider := &countingProvider{
+		err: errors.New("cloud unavailable"),
+	}
+	c := cache.New(provider, time.Hour, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, err := c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+		require.Error(t, err)
+	}
+	require.EqualValues(t, 2, atomic.LoadInt32(&provider.calls))
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	provider := &countingProvider{
+		instances: map[string]*controller.Instance{"name test-virtual-name": {ID: "test-instance-id"}},
+		release:   make(chan struct{}),
+	}
+	c := cache.New(provider, time.Hour, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance, err := c.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+			require.NoError(t, err)
+			require.Equal(t, "test-instance-id", instance.ID)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&provider.calls) == 1
+	}, time.Second, time.Millisecond)
+	// Let the other lookups join the call in flight.
+	time.Sleep(10 * time.Millisecond)
+	close(provider.release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&provider.calls))
+}
@@ -0,0 +1,73 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+// Provider resolves cloud instances for the controller.
+// Lookups a provider does not support fail with an error.
+type Provider interface {
+	GetInstance(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error)
+	// Stop ends the background work of the provider and releases its connections.
+	Stop()
+}
+
+// GroupResolver is implemented by providers that fill in the groups of instances, possibly depending on their configuration.
+type GroupResolver interface {
+	ResolvesGroups() bool
+}
+
+// ResolvesGroups reports whether the provider fills in the groups of instances, providers without GroupResolver do not.
+func ResolvesGroups(provider Provider) bool {
+	resolver, ok := provider.(GroupResolver)
+	return ok && resolver.ResolvesGroups()
+}
+
+// Factory builds a provider, reading its own configuration block.
+type Factory func() (Provider, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a provider available by name. It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("cloud provider %q is already registered", name))
+	}
+	factories[name] = factory
+}
+
+// New builds the provider registered by name.
+func New(name string) (Provider, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown cloud provider %q, registered: %v", name, Providers())
+	}
+	return factory()
+}
+
+// Providers returns the sorted names of registered providers.
+func Providers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
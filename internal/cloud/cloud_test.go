@@ -0,0 +1,77 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/fraima/cluster-machine-approver/internal/cloud"
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+type fakeProvider map[string]*controller.Instance
+
+func (s fakeProvider) GetInstance(_ context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	if lookup != controller.LookupName {
+		return nil, fmt.Errorf("lookup %q is not supported", lookup)
+	}
+	instance, ok := s[value]
+	if !ok {
+		return nil, fmt.Errorf("instance %q not found", value)
+	}
+	return instance, nil
+}
+
+func (s fakeProvider) Stop() {}
+
+func TestRegistry(t *testing.T) {
+	testInstance := &controller.Instance{
+		Addresses: []net.IP{
+			net.ParseIP("123.123.123.123"),
+		},
+	}
+
+	cloud.Register("fake", func() (cloud.Provider, error) {
+		return fakeProvider{"test-virtual-name": testInstance}, nil
+	})
+	cloud.Register("broken", func() (cloud.Provider, error) {
+		return nil, errors.New("invalid configuration")
+	})
+
+	require.Contains(t, cloud.Providers(), "fake")
+	require.Panics(t, func() {
+		cloud.Register("fake", nil)
+	})
+
+	provider, err := cloud.New("fake")
+	require.NoError(t, err)
+
+	instance, err := provider.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	require.Equal(t, testInstance, instance)
+
+	_, err = cloud.New("broken")
+	require.ErrorContains(t, err, "invalid configuration")
+
+	_, err = cloud.New("unknown")
+	require.ErrorContains(t, err, "unknown cloud provider")
+}
+
+type groupsProvider struct {
+	fakeProvider
+	resolve bool
+}
+
+func (s groupsProvider) ResolvesGroups() bool {
+	return s.resolve
+}
+
+func TestResolvesGroups(t *testing.T) {
+	require.False(t, cloud.ResolvesGroups(fakeProvider{}))
+	require.False(t, cloud.ResolvesGroups(groupsProvider{}))
+	require.True(t, cloud.ResolvesGroups(groupsProvider{resolve: true}))
+}
@@ -0,0 +1,34 @@
+package static
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/fraima/cluster-machine-approver/internal/cloud"
+)
+
+const ProviderName = "static"
+
+type configuration struct {
+	InventoryFile string        `envconfig:"INVENTORY_FILE" required:"true"`
+	ReloadPeriod  time.Duration `envconfig:"RELOAD_PERIOD" default:"30s"`
+}
+
+func init() {
+	cloud.Register(ProviderName, New)
+}
+
+// New loads the inventory configured by STATIC_* environment variables.
+func New() (cloud.Provider, error) {
+	var cfg configuration
+	if err := envconfig.Process(ProviderName, &cfg); err != nil {
+		return nil, err
+	}
+
+	s, err := Load(cfg.InventoryFile, cfg.ReloadPeriod)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
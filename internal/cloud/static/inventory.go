@@ -0,0 +1,213 @@
+package static
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+// defaultStatus is the status of instances listed without one.
+const defaultStatus = "RUNNING"
+
+// file is the YAML or JSON inventory layout.
+type file struct {
+	Instances []struct {
+		ID        string            `json:"id"`
+		Name      string            `json:"name"`
+		Addresses []string          `json:"addresses"`
+		Hostnames []string          `json:"hostnames"`
+		Status    string            `json:"status"`
+		Labels    map[string]string `json:"labels"`
+		Groups    []string          `json:"groups"`
+		CreatedAt time.Time         `json:"createdAt"`
+	} `json:"instances"`
+}
+
+type inventory struct {
+	path string
+
+	mu        sync.RWMutex
+	content   []byte
+	instances map[string]*controller.Instance
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Load reads the inventory file and rereads it every reloadPeriod until Stop.
+// A ConfigMap mounted as a volume can be used as the file, kubelet updates it in place.
+func Load(path string, reloadPeriod time.Duration) (*inventory, error) {
+	s := &inventory{
+		path: path,
+		stop: make(chan struct{}),
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadPeriod > 0 {
+		go s.watch(reloadPeriod)
+	}
+	return s, nil
+}
+
+// GetInstance finds the instance by name, by ID or by one of its hostnames.
+// Lookups that ask for fresh data reread the file first.
+func (s *inventory) GetInstance(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	if controller.FreshData(ctx) {
+		if err := s.reload(); err != nil {
+			zap.L().Warn("reload_inventory", zap.String("path", s.path), zap.Error(err))
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found []*controller.Instance
+	switch lookup {
+	case controller.LookupName:
+		if instance, ok := s.instances[value]; ok {
+			found = append(found, instance)
+		}
+	case controller.LookupID:
+		for _, instance := range s.instances {
+			if instance.ID != "" && instance.ID == value {
+				found = append(found, instance)
+			}
+		}
+	case controller.LookupFQDN:
+		for _, instance := range s.instances {
+			if hasHostname(instance, value) {
+				found = append(found, instance)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("lookup %q is not supported by inventory %s", lookup, s.path)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no instance with %s %q in inventory %s: %w", lookup, value, s.path, controller.ErrInstanceNotFound)
+	}
+	if len(found) > 1 {
+		return nil, fmt.Errorf("%d instances with %s %q in inventory %s: %w", len(found), lookup, value, s.path, controller.ErrAmbiguousInstance)
+	}
+	return found[0], nil
+}
+
+func hasHostname(instance *controller.Instance, fqdn string) bool {
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	for _, h := range instance.Hostnames {
+		if strings.ToLower(strings.TrimSuffix(h, ".")) == fqdn {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvesGroups is always true, an instance that lists no groups is in none.
+func (s *inventory) ResolvesGroups() bool {
+	return true
+}
+
+// Stop ends rereading the file.
+func (s *inventory) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *inventory) watch(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				zap.L().Warn("reload_inventory", zap.String("path", s.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// reload replaces the instances if the file content has changed, a broken file keeps the previous instances.
+func (s *inventory) reload() error {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	unchanged := s.instances != nil && bytes.Equal(content, s.content)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	instances, err := parse(content)
+	if err != nil {
+		return fmt.Errorf("parse inventory %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.content = content
+	s.instances = instances
+	s.mu.Unlock()
+
+	zap.L().Info("inventory_loaded", zap.String("path", s.path), zap.Int("instances", len(instances)))
+	return nil
+}
+
+func parse(content []byte) (map[string]*controller.Instance, error) {
+	var f file
+	if err := yaml.UnmarshalStrict(content, &f); err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]*controller.Instance, len(f.Instances))
+	for _, i := range f.Instances {
+		if i.Name == "" {
+			return nil, fmt.Errorf("instance without name")
+		}
+		if _, ok := instances[i.Name]; ok {
+			return nil, fmt.Errorf("instance %q is listed more than once", i.Name)
+		}
+
+		instance := &controller.Instance{
+			ID:        i.ID,
+			Hostnames: i.Hostnames,
+			Status:    i.Status,
+			Labels:    i.Labels,
+			Groups:    i.Groups,
+			CreatedAt: i.CreatedAt,
+		}
+		if instance.Status == "" {
+			instance.Status = defaultStatus
+		}
+		if instance.Groups == nil {
+			// The inventory lists every group of the instance, so it is in none.
+			instance.Groups = []string{}
+		}
+		for _, a := range i.Addresses {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("instance %q has invalid address %q", i.Name, a)
+			}
+			instance.Addresses = append(instance.Addresses, ip)
+		}
+		instances[i.Name] = instance
+	}
+	return instances, nil
+}
@@ -0,0 +1,112 @@
+package static_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/fraima/cluster-machine-approver/internal/cloud/static"
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+func TestInventory(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "inventory.yaml")
+
+	err := os.WriteFile(testPath, []byte(`
+instances:
+  - name: test-virtual-name
+    addresses:
+      - 123.123.123.123
+    hostnames:
+      - test-virtual-name
+`), 0o600)
+	require.NoError(t, err)
+
+	inventory, err := static.Load(testPath, 10*time.Millisecond)
+	require.NoError(t, err)
+	t.Cleanup(inventory.Stop)
+
+	instance, err := inventory.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("123.123.123.123")}, instance.Addresses)
+	require.Equal(t, []string{"test-virtual-name"}, instance.Hostnames)
+	require.Equal(t, "RUNNING", instance.Status)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+	require.Error(t, err)
+
+	err = os.WriteFile(testPath, []byte(`{"instances": [{"name": "other-virtual-name", "addresses": ["124.124.124.124"]}]}`), 0o600)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := inventory.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupName, "test-virtual-name")
+	require.Error(t, err)
+
+	// A broken file keeps the last valid inventory.
+	err = os.WriteFile(testPath, []byte(`instances: [{"name": "other-virtual-name", "addresses": ["not an ip"]}]`), 0o600)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupName, "other-virtual-name")
+	require.NoError(t, err)
+}
+
+func TestInventoryLookups(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "inventory.yaml")
+
+	err := os.WriteFile(testPath, []byte(`
+instances:
+  - name: test-virtual-name
+    id: test-instance-id
+    status: STOPPED
+    labels:
+      k8s-cluster: main
+    hostnames:
+      - test-virtual-name.example.com
+  - name: other-virtual-name
+    hostnames:
+      - test-virtual-name.example.com
+`), 0o600)
+	require.NoError(t, err)
+
+	inventory, err := static.Load(testPath, 0)
+	require.NoError(t, err)
+
+	instance, err := inventory.GetInstance(context.Background(), controller.LookupID, "test-instance-id")
+	require.NoError(t, err)
+	require.Equal(t, "test-instance-id", instance.ID)
+	require.Equal(t, "STOPPED", instance.Status)
+	require.Equal(t, map[string]string{"k8s-cluster": "main"}, instance.Labels)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupID, "other-instance-id")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupFQDN, "Test-Virtual-Name.example.com.")
+	require.ErrorIs(t, err, controller.ErrAmbiguousInstance)
+
+	_, err = inventory.GetInstance(context.Background(), controller.LookupProviderID, "static://test-instance-id")
+	require.Error(t, err)
+}
+
+func TestInvalidInventory(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "inventory.yaml")
+
+	err := os.WriteFile(testPath, []byte(`
+instances:
+  - name: test-virtual-name
+  - name: test-virtual-name
+`), 0o600)
+	require.NoError(t, err)
+
+	_, err = static.Load(testPath, 0)
+	require.ErrorContains(t, err, "more than once")
+}
@@ -4,20 +4,74 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	compute "github.com/yandex-cloud/go-genproto/yandex/cloud/compute/v1"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/resourcemanager/v1"
 	ycsdk "github.com/yandex-cloud/go-sdk"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
 )
 
+// instanceService is the part of the compute instance service the provider uses.
+type instanceService interface {
+	Get(ctx context.Context, in *compute.GetInstanceRequest, opts ...grpc.CallOption) (*compute.Instance, error)
+	List(ctx context.Context, in *compute.ListInstancesRequest, opts ...grpc.CallOption) (*compute.ListInstancesResponse, error)
+}
+
+// folderLister is the part of the resource manager folder service the provider uses.
+type folderLister interface {
+	List(ctx context.Context, in *resourcemanager.ListFoldersRequest, opts ...grpc.CallOption) (*resourcemanager.ListFoldersResponse, error)
+}
+
 type cloud struct {
-	folderID string
-	sdk      *ycsdk.SDK
+	folderIDs []string
+	// cloudID adds every folder of the cloud to folderIDs when it is set.
+	cloudID   string
+	sdk       *ycsdk.SDK
+	instances instanceService
+	folders   folderLister
+
+	// resolveGroups fills in the instance groups and node groups instances belong to.
+	// Without the index the membership of the folders is kept for membershipTTL.
+	resolveGroups  bool
+	instanceGroups instanceGroupService
+	nodeGroups     nodeGroupService
+	membership     map[string][]string
+	membershipAt   time.Time
+
+	// syncPeriod enables the instance index when it is not zero.
+	syncPeriod time.Duration
+	mu         sync.RWMutex
+	index      *instanceIndex
+	syncedAt   time.Time
+	syncGroup  singleflight.Group
+	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
+// ConnectCloud connects to the Yandex Cloud API, instances are searched in folderIDs and in every folder of cloudID.
+// With a non-zero syncPeriod the instances of the folders are listed every syncPeriod and looked up in memory,
+// otherwise every lookup lists the folders with a name filter.
+// With resolveGroups the instance groups and managed node groups of the folders are listed to find the groups of instances.
 func ConnectCloud(
 	iamJSON []byte,
-	folderID string,
+	folderIDs []string,
+	cloudID string,
+	syncPeriod time.Duration,
+	resolveGroups bool,
 ) (*cloud, error) {
+	if len(folderIDs) == 0 && cloudID == "" {
+		return nil, fmt.Errorf("neither folder IDs nor a cloud ID are set")
+	}
+
 	creds, err := getCredentials(iamJSON)
 	if err != nil {
 		return nil, err
@@ -28,31 +82,189 @@ func ConnectCloud(
 		return nil, err
 	}
 
+	s := newCloud(folderIDs, cloudID, sdk.Compute().Instance(), sdk.ResourceManager().Folder(), syncPeriod)
+	s.sdk = sdk
+	s.resolveGroups = resolveGroups
+	s.instanceGroups = sdk.InstanceGroup().InstanceGroup()
+	s.nodeGroups = sdk.Kubernetes().NodeGroup()
+	if syncPeriod > 0 {
+		go s.watch()
+	}
+	return s, nil
+}
+
+func newCloud(folderIDs []string, cloudID string, instances instanceService, folders folderLister, syncPeriod time.Duration) *cloud {
 	return &cloud{
-		folderID: folderID,
-		sdk:      sdk,
-	}, nil
+		folderIDs:  folderIDs,
+		cloudID:    cloudID,
+		instances:  instances,
+		folders:    folders,
+		syncPeriod: syncPeriod,
+		stop:       make(chan struct{}),
+	}
 }
 
-func (s *cloud) GetInstanceAddresses(ctx context.Context, instanceName string) ([]net.IP, error) {
-	result, err := s.sdk.Compute().Instance().List(ctx, &compute.ListInstancesRequest{
-		FolderId: s.folderID,
-		PageSize: 2,
-		Filter:   fmt.Sprintf("name = \"%s\"", instanceName),
-	})
+// GetInstance finds the instance by name, by ID or by FQDN.
+// The FQDN of an instance without a hostname is <instance id>.auto.internal, such instances are got by ID.
+func (s *cloud) GetInstance(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	if lookup == controller.LookupFQDN {
+		if id, ok := autoInstanceID(value); ok {
+			lookup, value = controller.LookupID, id
+		}
+	}
+
+	if s.syncPeriod > 0 {
+		return s.lookup(ctx, lookup, value)
+	}
 
+	instance, err := s.get(ctx, lookup, value)
+	if err != nil || !s.resolveGroups {
+		return instance, err
+	}
+
+	instance.Groups, err = s.instanceGroupIDs(ctx, instance.ID)
 	if err != nil {
 		return nil, err
 	}
+	return instance, nil
+}
 
-	if len(result.Instances) > 1 {
-		return nil, fmt.Errorf("more than 1 instances found by the name %q", instanceName)
+// ResolvesGroups reports whether the groups of instances are listed, see YANDEX_RESOLVE_GROUPS.
+func (s *cloud) ResolvesGroups() bool {
+	return s.resolveGroups
+}
+
+func (s *cloud) get(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	switch lookup {
+	case controller.LookupName:
+		return s.getByName(ctx, value)
+	case controller.LookupID:
+		return s.getByID(ctx, value)
 	}
-	if len(result.Instances) == 0 {
-		return nil, fmt.Errorf("no than 1 instances found by the name %q", instanceName)
+
+	index, err := s.listInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := index.find(lookup, value)
+	if err != nil {
+		return nil, err
+	}
+	return toInstance(lookup, value, instances)
+}
+
+// getByName lists the instances with the name, which is taken from the request and so validated before it is put into the filter.
+func (s *cloud) getByName(ctx context.Context, instanceName string) (*controller.Instance, error) {
+	if errs := validation.IsDNS1123Label(instanceName); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid instance name %q: %s: %w", instanceName, strings.Join(errs, ", "), controller.ErrInstanceNotFound)
+	}
+
+	folderIDs, err := s.listFolders(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return extractAddresses(result.Instances[0]), nil
+	var instances []*compute.Instance
+	for _, folderID := range folderIDs {
+		result, err := s.instances.List(ctx, &compute.ListInstancesRequest{
+			FolderId: folderID,
+			PageSize: 2,
+			Filter:   fmt.Sprintf("name = \"%s\"", instanceName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range result.Instances {
+			// Only an exact match may be returned, whatever the filter matched.
+			if instance.Name == instanceName {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return toInstance(controller.LookupName, instanceName, instances)
+}
+
+// getByID gets the instance, which must belong to one of the searched folders.
+func (s *cloud) getByID(ctx context.Context, instanceID string) (*controller.Instance, error) {
+	instance, err := s.instances.Get(ctx, &compute.GetInstanceRequest{InstanceId: instanceID})
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("no instance with id %q: %w", instanceID, controller.ErrInstanceNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	folderIDs, err := s.listFolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, folderID := range folderIDs {
+		if instance.FolderId == folderID {
+			return toInstance(controller.LookupID, instanceID, []*compute.Instance{instance})
+		}
+	}
+	return nil, fmt.Errorf("instance %s is in folder %s, which is not searched: %w", instanceID, instance.FolderId, controller.ErrInstanceNotFound)
+}
+
+// listFolders returns the configured folders and the folders of the configured cloud.
+func (s *cloud) listFolders(ctx context.Context) ([]string, error) {
+	if s.cloudID == "" {
+		return s.folderIDs, nil
+	}
+
+	folderIDs := append([]string(nil), s.folderIDs...)
+	known := make(map[string]bool, len(folderIDs))
+	for _, folderID := range folderIDs {
+		known[folderID] = true
+	}
+
+	request := &resourcemanager.ListFoldersRequest{
+		CloudId:  s.cloudID,
+		PageSize: listPageSize,
+	}
+	for {
+		result, err := s.folders.List(ctx, request)
+		if err != nil {
+			return nil, fmt.Errorf("list folders of cloud %s: %w", s.cloudID, err)
+		}
+		for _, folder := range result.Folders {
+			if !known[folder.Id] {
+				known[folder.Id] = true
+				folderIDs = append(folderIDs, folder.Id)
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return folderIDs, nil
+		}
+		request.PageToken = result.NextPageToken
+	}
+}
+
+// toInstance converts the instances found by the lookup, which must be exactly one.
+func toInstance(lookup controller.Lookup, value string, instances []*compute.Instance) (*controller.Instance, error) {
+	if len(instances) > 1 {
+		found := make([]string, 0, len(instances))
+		for _, instance := range instances {
+			found = append(found, fmt.Sprintf("%s in folder %s", instance.Id, instance.FolderId))
+		}
+		return nil, fmt.Errorf("%s %q matches instances %s: %w", lookup, value, strings.Join(found, ", "), controller.ErrAmbiguousInstance)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances found by %s %q: %w", lookup, value, controller.ErrInstanceNotFound)
+	}
+
+	instance := &controller.Instance{
+		ID:        instances[0].Id,
+		Addresses: extractAddresses(instances[0]),
+		Hostnames: extractHostnames(instances[0]),
+		Status:    instances[0].Status.String(),
+		Labels:    instances[0].Labels,
+	}
+	if instances[0].CreatedAt != nil {
+		instance.CreatedAt = instances[0].CreatedAt.AsTime()
+	}
+	return instance, nil
 }
 
 func extractAddresses(instance *compute.Instance) []net.IP {
@@ -68,3 +280,46 @@ func extractAddresses(instance *compute.Instance) []net.IP {
 	}
 	return nodeAddresses
 }
+
+// extractHostnames returns the instance FQDN, its short hostname and the FQDNs of the instance DNS records.
+func extractHostnames(instance *compute.Instance) []string {
+	var hostnames []string
+
+	if fqdn := strings.TrimSuffix(instance.GetFqdn(), "."); fqdn != "" {
+		hostnames = append(hostnames, fqdn)
+		if hostname, _, found := strings.Cut(fqdn, "."); found {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	for _, iface := range instance.NetworkInterfaces {
+		address := iface.GetPrimaryV4Address()
+		if address == nil {
+			continue
+		}
+		records := address.GetDnsRecords()
+		if address.GetOneToOneNat() != nil {
+			records = append(records, address.GetOneToOneNat().GetDnsRecords()...)
+		}
+		for _, record := range records {
+			hostnames = append(hostnames, strings.TrimSuffix(record.GetFqdn(), "."))
+		}
+	}
+	return hostnames
+}
+
+const autoDomain = ".auto.internal"
+
+// autoInstanceID returns the instance ID of an <instance id>.auto.internal FQDN.
+func autoInstanceID(fqdn string) (string, bool) {
+	fqdn = normalizeFQDN(fqdn)
+	if !strings.HasSuffix(fqdn, autoDomain) {
+		return "", false
+	}
+	id := strings.TrimSuffix(fqdn, autoDomain)
+	return id, id != "" && !strings.Contains(id, ".")
+}
+
+func normalizeFQDN(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(fqdn, "."))
+}
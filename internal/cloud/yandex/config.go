@@ -0,0 +1,43 @@
+package yandex
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	cloudprovider "github.com/fraima/cluster-machine-approver/internal/cloud"
+)
+
+const ProviderName = "yandex"
+
+type configuration struct {
+	AIMJson       []byte        `envconfig:"AIM_JSON" required:"true"`
+	FolderID      string        `envconfig:"FOLDER_ID"`
+	FolderIDs     []string      `envconfig:"FOLDER_IDS"`
+	CloudID       string        `envconfig:"CLOUD_ID"`
+	SyncPeriod    time.Duration `envconfig:"SYNC_PERIOD"`
+	ResolveGroups bool          `envconfig:"RESOLVE_GROUPS"`
+}
+
+func init() {
+	cloudprovider.Register(ProviderName, New)
+}
+
+// New connects the provider configured by YANDEX_* environment variables.
+func New() (cloudprovider.Provider, error) {
+	var cfg configuration
+	if err := envconfig.Process(ProviderName, &cfg); err != nil {
+		return nil, err
+	}
+
+	folderIDs := cfg.FolderIDs
+	if cfg.FolderID != "" {
+		folderIDs = append(folderIDs, cfg.FolderID)
+	}
+
+	c, err := ConnectCloud(cfg.AIMJson, folderIDs, cfg.CloudID, cfg.SyncPeriod, cfg.ResolveGroups)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,156 @@
+package yandex
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/compute/v1/instancegroup"
+	k8s "github.com/yandex-cloud/go-genproto/yandex/cloud/k8s/v1"
+	"google.golang.org/grpc"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+// instanceGroupService is the part of the instance group service the provider uses.
+type instanceGroupService interface {
+	List(ctx context.Context, in *instancegroup.ListInstanceGroupsRequest, opts ...grpc.CallOption) (*instancegroup.ListInstanceGroupsResponse, error)
+	ListInstances(ctx context.Context, in *instancegroup.ListInstanceGroupInstancesRequest, opts ...grpc.CallOption) (*instancegroup.ListInstanceGroupInstancesResponse, error)
+}
+
+// nodeGroupService is the part of the managed Kubernetes node group service the provider uses.
+type nodeGroupService interface {
+	List(ctx context.Context, in *k8s.ListNodeGroupsRequest, opts ...grpc.CallOption) (*k8s.ListNodeGroupsResponse, error)
+}
+
+// membershipTTL is how long the group membership is kept without the instance index.
+const membershipTTL = time.Minute
+
+// instanceGroupIDs returns the groups of the instance from the group membership of the folders.
+// The membership is listed again when it is older than membershipTTL, when fresh data is asked for
+// or when the instance is in no group and the membership is older than minRefreshInterval, as the instance may be new.
+func (s *cloud) instanceGroupIDs(ctx context.Context, instanceID string) ([]string, error) {
+	s.mu.RLock()
+	membership, age := s.membership, time.Since(s.membershipAt)
+	s.mu.RUnlock()
+
+	_, known := membership[instanceID]
+	if membership == nil || age >= membershipTTL || (!known && age >= minRefreshInterval) || controller.FreshData(ctx) {
+		v, err, _ := s.syncGroup.Do("groups", func() (interface{}, error) {
+			folderIDs, err := s.listFolders(ctx)
+			if err != nil {
+				return nil, err
+			}
+			membership, err := s.groupMembership(ctx, folderIDs)
+			if err != nil {
+				return nil, err
+			}
+
+			s.mu.Lock()
+			s.membership = membership
+			s.membershipAt = time.Now()
+			s.mu.Unlock()
+			return membership, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		membership = v.(map[string][]string)
+	}
+	return groupsOf(membership, instanceID), nil
+}
+
+// groupsOf returns the groups of the instance, empty but not nil if it is in none, as the groups are resolved.
+func groupsOf(membership map[string][]string, instanceID string) []string {
+	if groups := membership[instanceID]; groups != nil {
+		return groups
+	}
+	return []string{}
+}
+
+// groupMembership maps the ID of every instance created by an instance group of the folders
+// to the ID of that group and, if the group backs a managed Kubernetes node group, to the node group ID.
+func (s *cloud) groupMembership(ctx context.Context, folderIDs []string) (map[string][]string, error) {
+	membership := make(map[string][]string)
+	for _, folderID := range folderIDs {
+		nodeGroups, err := s.listNodeGroups(ctx, folderID)
+		if err != nil {
+			return nil, err
+		}
+
+		request := &instancegroup.ListInstanceGroupsRequest{
+			FolderId: folderID,
+			PageSize: listPageSize,
+		}
+		for {
+			result, err := s.instanceGroups.List(ctx, request)
+			if err != nil {
+				return nil, fmt.Errorf("list instance groups of folder %s: %w", folderID, err)
+			}
+			for _, group := range result.InstanceGroups {
+				groupIDs := []string{group.Id}
+				if nodeGroupID, ok := nodeGroups[group.Id]; ok {
+					groupIDs = append(groupIDs, nodeGroupID)
+				}
+				if err := s.addGroupInstances(ctx, membership, group.Id, groupIDs); err != nil {
+					return nil, err
+				}
+			}
+
+			if result.NextPageToken == "" {
+				break
+			}
+			request.PageToken = result.NextPageToken
+		}
+	}
+	return membership, nil
+}
+
+func (s *cloud) addGroupInstances(ctx context.Context, membership map[string][]string, instanceGroupID string, groupIDs []string) error {
+	request := &instancegroup.ListInstanceGroupInstancesRequest{
+		InstanceGroupId: instanceGroupID,
+		PageSize:        listPageSize,
+	}
+	for {
+		result, err := s.instanceGroups.ListInstances(ctx, request)
+		if err != nil {
+			return fmt.Errorf("list instances of instance group %s: %w", instanceGroupID, err)
+		}
+		for _, instance := range result.Instances {
+			if instance.InstanceId != "" {
+				membership[instance.InstanceId] = append(membership[instance.InstanceId], groupIDs...)
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return nil
+		}
+		request.PageToken = result.NextPageToken
+	}
+}
+
+// listNodeGroups maps the instance group IDs of the node groups of the folder to the node group IDs.
+func (s *cloud) listNodeGroups(ctx context.Context, folderID string) (map[string]string, error) {
+	nodeGroups := make(map[string]string)
+
+	request := &k8s.ListNodeGroupsRequest{
+		FolderId: folderID,
+		PageSize: listPageSize,
+	}
+	for {
+		result, err := s.nodeGroups.List(ctx, request)
+		if err != nil {
+			return nil, fmt.Errorf("list node groups of folder %s: %w", folderID, err)
+		}
+		for _, group := range result.NodeGroups {
+			if group.InstanceGroupId != "" {
+				nodeGroups[group.InstanceGroupId] = group.Id
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return nodeGroups, nil
+		}
+		request.PageToken = result.NextPageToken
+	}
+}
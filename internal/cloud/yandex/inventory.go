@@ -0,0 +1,190 @@
+package yandex
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	compute "github.com/yandex-cloud/go-genproto/yandex/cloud/compute/v1"
+	"go.uber.org/zap"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+const (
+	listPageSize = 1000
+	syncTimeout  = time.Minute
+	// shutdownTimeout bounds closing the SDK connections on Stop.
+	shutdownTimeout = 5 * time.Second
+	// minRefreshInterval limits the refreshes forced by lookups of unknown names.
+	minRefreshInterval = 5 * time.Second
+)
+
+// Stop ends the instance index sync and closes the connections of the SDK.
+func (s *cloud) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.sdk == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.sdk.Shutdown(ctx); err != nil {
+			zap.L().Warn("shutdown_sdk", zap.Error(err))
+		}
+	})
+}
+
+func (s *cloud) watch() {
+	ticker := time.NewTicker(s.syncPeriod)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+		if err := s.refresh(ctx); err != nil {
+			zap.L().Warn("sync_instances", zap.Strings("folder_ids", s.folderIDs), zap.String("cloud_id", s.cloudID), zap.Error(err))
+		}
+		cancel()
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// instanceIndex holds the instances of the folders by every attribute they can be looked up by.
+type instanceIndex struct {
+	byName map[string][]*compute.Instance
+	byID   map[string][]*compute.Instance
+	byFQDN map[string][]*compute.Instance
+	// groups maps instance IDs to their group IDs if groups are resolved.
+	groups map[string][]string
+}
+
+func newInstanceIndex() *instanceIndex {
+	return &instanceIndex{
+		byName: make(map[string][]*compute.Instance),
+		byID:   make(map[string][]*compute.Instance),
+		byFQDN: make(map[string][]*compute.Instance),
+	}
+}
+
+func (s *instanceIndex) add(instance *compute.Instance) {
+	s.byName[instance.Name] = append(s.byName[instance.Name], instance)
+	s.byID[instance.Id] = append(s.byID[instance.Id], instance)
+	for _, hostname := range extractHostnames(instance) {
+		if strings.Contains(hostname, ".") {
+			fqdn := normalizeFQDN(hostname)
+			s.byFQDN[fqdn] = append(s.byFQDN[fqdn], instance)
+		}
+	}
+}
+
+func (s *instanceIndex) find(lookup controller.Lookup, value string) ([]*compute.Instance, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	switch lookup {
+	case controller.LookupName:
+		return s.byName[value], nil
+	case controller.LookupID:
+		return s.byID[value], nil
+	case controller.LookupFQDN:
+		return s.byFQDN[normalizeFQDN(value)], nil
+	}
+	return nil, fmt.Errorf("lookup %q is not supported by the yandex provider", lookup)
+}
+
+// lookup finds the instance in the index, refreshing it first if the instance is unknown or fresh data is asked for.
+func (s *cloud) lookup(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	s.mu.RLock()
+	index, syncedAt := s.index, s.syncedAt
+	s.mu.RUnlock()
+
+	instances, err := index.find(lookup, value)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := len(instances) == 0 && time.Since(syncedAt) >= minRefreshInterval
+	if stale || controller.FreshData(ctx) {
+		if err := s.refresh(ctx); err != nil {
+			return nil, err
+		}
+
+		s.mu.RLock()
+		index = s.index
+		s.mu.RUnlock()
+		instances, _ = index.find(lookup, value)
+	}
+
+	instance, err := toInstance(lookup, value, instances)
+	if err != nil {
+		return nil, err
+	}
+	if index.groups != nil {
+		instance.Groups = groupsOf(index.groups, instance.ID)
+	}
+	return instance, nil
+}
+
+// refresh lists every instance of the folders and replaces the index, concurrent refreshes share one listing.
+func (s *cloud) refresh(ctx context.Context) error {
+	_, err, _ := s.syncGroup.Do("sync", func() (interface{}, error) {
+		index, err := s.listInstances(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		s.index = index
+		s.syncedAt = time.Now()
+		s.mu.Unlock()
+
+		zap.L().Debug("instances_synced", zap.Int("instances", len(index.byID)))
+		return nil, nil
+	})
+	return err
+}
+
+func (s *cloud) listInstances(ctx context.Context) (*instanceIndex, error) {
+	folderIDs, err := s.listFolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newInstanceIndex()
+	for _, folderID := range folderIDs {
+		request := &compute.ListInstancesRequest{
+			FolderId: folderID,
+			PageSize: listPageSize,
+		}
+		for {
+			result, err := s.instances.List(ctx, request)
+			if err != nil {
+				return nil, fmt.Errorf("list instances of folder %s: %w", folderID, err)
+			}
+			for _, instance := range result.Instances {
+				index.add(instance)
+			}
+
+			if result.NextPageToken == "" {
+				break
+			}
+			request.PageToken = result.NextPageToken
+		}
+	}
+
+	if s.resolveGroups {
+		index.groups, err = s.groupMembership(ctx, folderIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
@@ -0,0 +1,387 @@
+package yandex
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	compute "github.com/yandex-cloud/go-genproto/yandex/cloud/compute/v1"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/compute/v1/instancegroup"
+	k8s "github.com/yandex-cloud/go-genproto/yandex/cloud/k8s/v1"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/resourcemanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+// fakeLister serves folder instances, listing them in pages of two.
+type fakeLister struct {
+	mu        sync.Mutex
+	instances map[string][]*compute.Instance
+	calls     int
+}
+
+func (s *fakeLister) List(_ context.Context, in *compute.ListInstancesRequest, _ ...grpc.CallOption) (*compute.ListInstancesResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+
+	instances := s.instances[in.FolderId]
+	if in.Filter != "" {
+		name := strings.TrimSuffix(strings.TrimPrefix(in.Filter, `name = "`), `"`)
+		var filtered []*compute.Instance
+		for _, instance := range instances {
+			if instance.Name == name {
+				filtered = append(filtered, instance)
+			}
+		}
+		instances = filtered
+	}
+	start := 0
+	if in.PageToken != "" {
+		start, _ = strconv.Atoi(in.PageToken)
+	}
+	end := start + 2
+	if end >= len(instances) {
+		return &compute.ListInstancesResponse{Instances: instances[start:]}, nil
+	}
+	return &compute.ListInstancesResponse{
+		Instances:     instances[start:end],
+		NextPageToken: strconv.Itoa(end),
+	}, nil
+}
+
+func (s *fakeLister) Get(_ context.Context, in *compute.GetInstanceRequest, _ ...grpc.CallOption) (*compute.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+
+	for _, instances := range s.instances {
+		for _, instance := range instances {
+			if instance.Id == in.InstanceId {
+				return instance, nil
+			}
+		}
+	}
+	return nil, status.Error(codes.NotFound, "instance not found")
+}
+
+func (s *fakeLister) add(folderID string, instance *compute.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance.FolderId = folderID
+	s.instances[folderID] = append(s.instances[folderID], instance)
+}
+
+// fakeFolders serves the folders of a cloud one per page.
+type fakeFolders map[string][]string
+
+func (s fakeFolders) List(_ context.Context, in *resourcemanager.ListFoldersRequest, _ ...grpc.CallOption) (*resourcemanager.ListFoldersResponse, error) {
+	folderIDs := s[in.CloudId]
+	start := 0
+	if in.PageToken != "" {
+		start, _ = strconv.Atoi(in.PageToken)
+	}
+	if start >= len(folderIDs) {
+		return &resourcemanager.ListFoldersResponse{}, nil
+	}
+
+	response := &resourcemanager.ListFoldersResponse{
+		Folders: []*resourcemanager.Folder{{Id: folderIDs[start], CloudId: in.CloudId}},
+	}
+	if start+1 < len(folderIDs) {
+		response.NextPageToken = strconv.Itoa(start + 1)
+	}
+	return response, nil
+}
+
+// fakeGroups serves instance groups with the IDs of their instances.
+type fakeGroups map[string][]string
+
+func (s fakeGroups) List(_ context.Context, in *instancegroup.ListInstanceGroupsRequest, _ ...grpc.CallOption) (*instancegroup.ListInstanceGroupsResponse, error) {
+	response := &instancegroup.ListInstanceGroupsResponse{}
+	for id := range s {
+		response.InstanceGroups = append(response.InstanceGroups, &instancegroup.InstanceGroup{Id: id, FolderId: in.FolderId})
+	}
+	return response, nil
+}
+
+func (s fakeGroups) ListInstances(_ context.Context, in *instancegroup.ListInstanceGroupInstancesRequest, _ ...grpc.CallOption) (*instancegroup.ListInstanceGroupInstancesResponse, error) {
+	response := &instancegroup.ListInstanceGroupInstancesResponse{}
+	for _, id := range s[in.InstanceGroupId] {
+		response.Instances = append(response.Instances, &instancegroup.ManagedInstance{InstanceId: id})
+	}
+	return response, nil
+}
+
+type fakeNodeGroups map[string]string
+
+func (s fakeNodeGroups) List(_ context.Context, in *k8s.ListNodeGroupsRequest, _ ...grpc.CallOption) (*k8s.ListNodeGroupsResponse, error) {
+	response := &k8s.ListNodeGroupsResponse{}
+	for instanceGroupID, id := range s {
+		response.NodeGroups = append(response.NodeGroups, &k8s.NodeGroup{Id: id, InstanceGroupId: instanceGroupID})
+	}
+	return response, nil
+}
+
+// countingNodeGroups counts the node group listings.
+type countingNodeGroups struct {
+	fakeNodeGroups
+	calls int
+}
+
+func (s *countingNodeGroups) List(ctx context.Context, in *k8s.ListNodeGroupsRequest, opts ...grpc.CallOption) (*k8s.ListNodeGroupsResponse, error) {
+	s.calls++
+	return s.fakeNodeGroups.List(ctx, in, opts...)
+}
+
+func testInstance(id, name, address string) *compute.Instance {
+	return &compute.Instance{
+		Id:     id,
+		Name:   name,
+		Fqdn:   name + ".ru-central1.internal",
+		Status: compute.Instance_RUNNING,
+		Labels: map[string]string{"k8s-cluster": "main"},
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{PrimaryV4Address: &compute.PrimaryAddress{Address: address}},
+		},
+	}
+}
+
+func TestInventorySync(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	for i := 1; i <= 5; i++ {
+		lister.add("test-folder", testInstance("id-"+strconv.Itoa(i), "node-"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i)))
+	}
+	s := newCloud([]string{"test-folder"}, "", lister, nil, time.Hour)
+
+	require.NoError(t, s.refresh(context.Background()))
+	require.Equal(t, 3, lister.calls)
+
+	instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-5")
+	require.NoError(t, err)
+	require.Equal(t, &controller.Instance{
+		ID:        "id-5",
+		Addresses: []net.IP{net.ParseIP("10.0.0.5")},
+		Hostnames: []string{"node-5.ru-central1.internal", "node-5"},
+		Status:    "RUNNING",
+		Labels:    map[string]string{"k8s-cluster": "main"},
+	}, instance)
+	require.Equal(t, 3, lister.calls)
+}
+
+func TestInventoryRefreshOnMiss(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+	s := newCloud([]string{"test-folder"}, "", lister, nil, time.Hour)
+
+	require.NoError(t, s.refresh(context.Background()))
+	s.syncedAt = time.Now().Add(-minRefreshInterval)
+
+	lister.add("test-folder", testInstance("id-2", "node-2", "10.0.0.2"))
+	instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-2")
+	require.NoError(t, err)
+	require.Equal(t, "id-2", instance.ID)
+	require.Equal(t, 2, lister.calls)
+
+	// The index was just refreshed, so an unknown name does not list the folder again.
+	_, err = s.GetInstance(context.Background(), controller.LookupName, "node-3")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	require.Equal(t, 2, lister.calls)
+}
+
+func TestInventoryFreshData(t *testing.T) {
+	starting := testInstance("id-1", "node-1", "10.0.0.1")
+	starting.Status = compute.Instance_PROVISIONING
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", starting)
+	s := newCloud([]string{"test-folder"}, "", lister, nil, time.Hour)
+
+	require.NoError(t, s.refresh(context.Background()))
+	lister.instances["test-folder"] = nil
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+
+	// A known instance is answered from the index even though it was just synced.
+	instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-1")
+	require.NoError(t, err)
+	require.Equal(t, "PROVISIONING", instance.Status)
+	require.Equal(t, 1, lister.calls)
+
+	instance, err = s.GetInstance(controller.WithFreshData(context.Background()), controller.LookupName, "node-1")
+	require.NoError(t, err)
+	require.Equal(t, "RUNNING", instance.Status)
+	require.Equal(t, 2, lister.calls)
+}
+
+func TestInventoryDuplicateName(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+	lister.add("test-folder", testInstance("id-2", "node-1", "10.0.0.2"))
+	s := newCloud([]string{"test-folder"}, "", lister, nil, time.Hour)
+
+	_, err := s.GetInstance(context.Background(), controller.LookupName, "node-1")
+	require.ErrorIs(t, err, controller.ErrAmbiguousInstance)
+}
+
+func TestMultipleFolders(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("folder-a", testInstance("id-1", "node-1", "10.0.0.1"))
+	lister.add("folder-b", testInstance("id-2", "node-2", "10.0.0.2"))
+	lister.add("folder-c", testInstance("id-3", "node-3", "10.0.0.3"))
+	lister.add("folder-c", testInstance("id-4", "node-1", "10.0.0.4"))
+
+	for _, syncPeriod := range []time.Duration{0, time.Hour} {
+		t.Run(syncPeriod.String(), func(t *testing.T) {
+			s := newCloud([]string{"folder-a", "folder-b"}, "", lister, nil, syncPeriod)
+
+			instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-2")
+			require.NoError(t, err)
+			require.Equal(t, "id-2", instance.ID)
+
+			_, err = s.GetInstance(context.Background(), controller.LookupName, "node-3")
+			require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+
+			// Folders of the cloud are searched too.
+			s = newCloud([]string{"folder-a"}, "test-cloud", lister, fakeFolders{
+				"test-cloud": {"folder-b", "folder-c"},
+			}, syncPeriod)
+
+			instance, err = s.GetInstance(context.Background(), controller.LookupName, "node-3")
+			require.NoError(t, err)
+			require.Equal(t, "id-3", instance.ID)
+
+			_, err = s.GetInstance(context.Background(), controller.LookupName, "node-1")
+			require.ErrorIs(t, err, controller.ErrAmbiguousInstance)
+			require.Contains(t, err.Error(), "id-1 in folder folder-a")
+			require.Contains(t, err.Error(), "id-4 in folder folder-c")
+		})
+	}
+}
+
+// unfilteredLister ignores the name filter, as a filter injected into the request would.
+type unfilteredLister struct {
+	*fakeLister
+}
+
+func (s unfilteredLister) List(ctx context.Context, in *compute.ListInstancesRequest, opts ...grpc.CallOption) (*compute.ListInstancesResponse, error) {
+	in.Filter = ""
+	return s.fakeLister.List(ctx, in, opts...)
+}
+
+func TestGetByName(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+
+	s := newCloud([]string{"test-folder"}, "", unfilteredLister{lister}, nil, 0)
+
+	instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-1")
+	require.NoError(t, err)
+	require.Equal(t, "id-1", instance.ID)
+
+	_, err = s.GetInstance(context.Background(), controller.LookupName, "node-2")
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound, "instances with another name are not returned")
+
+	calls := lister.calls
+	_, err = s.GetInstance(context.Background(), controller.LookupName, `node-1" OR name != "`)
+	require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+	require.Equal(t, calls, lister.calls, "invalid names are not put into the filter")
+}
+
+func TestLookups(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("folder-a", testInstance("id-1", "node-1", "10.0.0.1"))
+	lister.add("folder-b", testInstance("id-2", "node-2", "10.0.0.2"))
+
+	for _, syncPeriod := range []time.Duration{0, time.Hour} {
+		t.Run(syncPeriod.String(), func(t *testing.T) {
+			s := newCloud([]string{"folder-a"}, "", lister, nil, syncPeriod)
+
+			instance, err := s.GetInstance(context.Background(), controller.LookupID, "id-1")
+			require.NoError(t, err)
+			require.Equal(t, "id-1", instance.ID)
+
+			instance, err = s.GetInstance(context.Background(), controller.LookupFQDN, "Node-1.ru-central1.internal.")
+			require.NoError(t, err)
+			require.Equal(t, "id-1", instance.ID)
+
+			instance, err = s.GetInstance(context.Background(), controller.LookupFQDN, "id-1.auto.internal")
+			require.NoError(t, err)
+			require.Equal(t, "id-1", instance.ID)
+
+			// Instances of folders that are not searched are not found by ID either.
+			_, err = s.GetInstance(context.Background(), controller.LookupID, "id-2")
+			require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+
+			_, err = s.GetInstance(context.Background(), controller.LookupFQDN, "node-2.ru-central1.internal")
+			require.ErrorIs(t, err, controller.ErrInstanceNotFound)
+
+			_, err = s.GetInstance(context.Background(), controller.LookupProviderID, "yandex://id-1")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+	lister.add("test-folder", testInstance("id-2", "node-2", "10.0.0.2"))
+	lister.add("test-folder", testInstance("id-3", "node-3", "10.0.0.3"))
+
+	for _, syncPeriod := range []time.Duration{0, time.Hour} {
+		t.Run(syncPeriod.String(), func(t *testing.T) {
+			s := newCloud([]string{"test-folder"}, "", lister, nil, syncPeriod)
+			s.resolveGroups = true
+			s.instanceGroups = fakeGroups{
+				"ig-1": {"id-1"},
+				"ig-2": {"id-2"},
+			}
+			s.nodeGroups = fakeNodeGroups{"ig-1": "ng-1"}
+
+			instance, err := s.GetInstance(context.Background(), controller.LookupName, "node-1")
+			require.NoError(t, err)
+			require.Equal(t, []string{"ig-1", "ng-1"}, instance.Groups)
+
+			instance, err = s.GetInstance(context.Background(), controller.LookupID, "id-2")
+			require.NoError(t, err)
+			require.Equal(t, []string{"ig-2"}, instance.Groups)
+
+			instance, err = s.GetInstance(context.Background(), controller.LookupName, "node-3")
+			require.NoError(t, err)
+			require.NotNil(t, instance.Groups)
+			require.Empty(t, instance.Groups)
+		})
+	}
+}
+
+func TestGroupsMembershipCached(t *testing.T) {
+	lister := &fakeLister{instances: map[string][]*compute.Instance{}}
+	lister.add("test-folder", testInstance("id-1", "node-1", "10.0.0.1"))
+	lister.add("test-folder", testInstance("id-2", "node-2", "10.0.0.2"))
+
+	nodeGroups := &countingNodeGroups{fakeNodeGroups: fakeNodeGroups{"ig-1": "ng-1"}}
+	s := newCloud([]string{"test-folder"}, "", lister, nil, 0)
+	s.resolveGroups = true
+	s.instanceGroups = fakeGroups{
+		"ig-1": {"id-1"},
+		"ig-2": {"id-2"},
+	}
+	s.nodeGroups = nodeGroups
+
+	for _, name := range []string{"node-1", "node-2", "node-1"} {
+		_, err := s.GetInstance(context.Background(), controller.LookupName, name)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, nodeGroups.calls)
+
+	instance, err := s.GetInstance(controller.WithFreshData(context.Background()), controller.LookupName, "node-1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ig-1", "ng-1"}, instance.Groups)
+	require.Equal(t, 2, nodeGroups.calls)
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/certificates/v1"
+)
+
+// AuditSink durably stores a record of every decision.
+type AuditSink interface {
+	Write(record AuditRecord) error
+}
+
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	Name     string   `json:"name"`
+	UID      string   `json:"uid"`
+	Signer   string   `json:"signer"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+
+	CommonName     string   `json:"commonName,omitempty"`
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+
+	InstanceID        string            `json:"instanceID,omitempty"`
+	InstanceAddresses []string          `json:"instanceAddresses,omitempty"`
+	InstanceHostnames []string          `json:"instanceHostnames,omitempty"`
+	InstanceStatus    string            `json:"instanceStatus,omitempty"`
+	InstanceLabels    map[string]string `json:"instanceLabels,omitempty"`
+	InstanceGroups    []string          `json:"instanceGroups,omitempty"`
+	InstanceCreatedAt *time.Time        `json:"instanceCreatedAt,omitempty"`
+
+	Rules []RuleResult `json:"rules,omitempty"`
+
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message,omitempty"`
+	DryRun   bool   `json:"dryRun"`
+}
+
+type RuleResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+}
+
+// evaluation collects what a verification looked at, for the audit log.
+type evaluation struct {
+	csr      *x509.CertificateRequest
+	instance *Instance
+	rules    []RuleResult
+}
+
+// check records the result of a rule and returns it.
+func (e *evaluation) check(name string, passed bool) bool {
+	e.rules = append(e.rules, RuleResult{Name: name, Passed: passed})
+	return passed
+}
+
+func newAuditRecord(r *v1.CertificateSigningRequest, d decision, dryRun bool) AuditRecord {
+	record := AuditRecord{
+		Time:     time.Now().UTC(),
+		Name:     r.Name,
+		UID:      string(r.UID),
+		Signer:   r.Spec.SignerName,
+		Username: r.Spec.Username,
+		Groups:   r.Spec.Groups,
+		Decision: string(d.verdict),
+		Reason:   d.reason,
+		Message:  d.message,
+		DryRun:   dryRun,
+	}
+	if d.err != nil {
+		record.Message = d.err.Error()
+	}
+
+	ev := d.evaluation
+	if ev == nil {
+		return record
+	}
+	record.Rules = ev.rules
+
+	if ev.csr != nil {
+		record.CommonName = ev.csr.Subject.CommonName
+		record.DNSNames = ev.csr.DNSNames
+		record.EmailAddresses = ev.csr.EmailAddresses
+		for _, ip := range ev.csr.IPAddresses {
+			record.IPAddresses = append(record.IPAddresses, ip.String())
+		}
+		for _, uri := range ev.csr.URIs {
+			record.URIs = append(record.URIs, uri.String())
+		}
+	}
+
+	if ev.instance != nil {
+		record.InstanceID = ev.instance.ID
+		record.InstanceHostnames = ev.instance.Hostnames
+		record.InstanceStatus = ev.instance.Status
+		record.InstanceLabels = ev.instance.Labels
+		record.InstanceGroups = ev.instance.Groups
+		if !ev.instance.CreatedAt.IsZero() {
+			record.InstanceCreatedAt = &ev.instance.CreatedAt
+		}
+		for _, ip := range ev.instance.Addresses {
+			record.InstanceAddresses = append(record.InstanceAddresses, ip.String())
+		}
+	}
+	return record
+}
+
+type jsonLinesSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewStdoutAuditSink writes records to stdout as JSON lines.
+func NewStdoutAuditSink() AuditSink {
+	return newJSONLinesSink(os.Stdout)
+}
+
+// NewFileAuditSink appends records to the file at path as JSON lines, syncing after each record.
+func NewFileAuditSink(path string) (AuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return newJSONLinesSink(f), nil
+}
+
+func newJSONLinesSink(w io.Writer) *jsonLinesSink {
+	return &jsonLinesSink{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (s *jsonLinesSink) Write(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(record); err != nil {
+		return err
+	}
+	if f, ok := s.w.(*os.File); ok && f != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
@@ -4,115 +4,654 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 	v1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fraima/cluster-machine-approver/internal/health"
+	"github.com/fraima/cluster-machine-approver/internal/metrics"
 )
 
+// Event is a request seen by the watch, a request that is being deleted has DeletionTimestamp set.
 type Event *v1.CertificateSigningRequest
 
+// heartbeatInterval is how often the intake loop reports to the liveness probe while no requests arrive.
+const heartbeatInterval = 10 * time.Second
+
+// ErrInstanceNotFound is wrapped by clouds when no instance matches the lookup.
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// ErrAmbiguousInstance is wrapped by clouds when more than one instance matches the lookup.
+var ErrAmbiguousInstance = errors.New("instance is ambiguous")
+
+// Instance is a cloud virtual machine as seen by the approver.
+type Instance struct {
+	ID        string
+	Addresses []net.IP
+	// Hostnames are the DNS names the instance is known by.
+	Hostnames []string
+	// Status is the cloud specific state of the instance, e.g. RUNNING.
+	Status string
+	Labels map[string]string
+	// Groups are the IDs of the instance groups and node groups the instance belongs to,
+	// nil if the cloud does not resolve them and empty if the instance is in no group.
+	Groups []string
+	// CreatedAt is the creation time of the instance, zero if the cloud does not report it.
+	CreatedAt time.Time
+}
+
 type cloud interface {
-	GetInstanceAddresses(ctx context.Context, instanceName string) ([]net.IP, error)
+	GetInstance(ctx context.Context, lookup Lookup, value string) (*Instance, error)
 }
 
 type k8s interface {
 	CertificateSigningRequestsChan() (<-chan Event, error)
-	Approve(ctx context.Context, r *v1.CertificateSigningRequest) error
-	Deny(ctx context.Context, r *v1.CertificateSigningRequest) error
+	Approve(ctx context.Context, r *v1.CertificateSigningRequest, e Explanation) error
+	Deny(ctx context.Context, r *v1.CertificateSigningRequest, e Explanation) error
+	// GetNode returns the node by name or nil if it is not registered.
+	GetNode(ctx context.Context, name string) (*corev1.Node, error)
+	Annotate(ctx context.Context, r *v1.CertificateSigningRequest, annotations map[string]string) error
 	Stop()
 }
 
+type Config struct {
+	InstanceNameLayout string
+	// InstanceLookup is how the instance of a request is found, the name by default.
+	InstanceLookup Lookup
+	// Signers maps a signer name to the name of the policy its requests are verified with.
+	// Requests for any other signer are ignored.
+	Signers map[string]string
+
+	// NodeGroups are the groups of kubelet identities, their members may only request certificates for their own name.
+	NodeGroups []string
+	// BootstrapGroups are the groups of bootstrap token identities, allowed to request kubelet client certificates.
+	BootstrapGroups []string
+
+	// KeyAlgorithms lists the public key algorithms allowed in serving requests.
+	KeyAlgorithms []string
+	// MinRSAKeySize and MinECDSAKeySize are the minimum key sizes in bits allowed in serving requests.
+	MinRSAKeySize   int
+	MinECDSAKeySize int
+
+	// DNSSuffixes are extra domains an instance hostname may be qualified with in DNS SANs.
+	DNSSuffixes []string
+
+	// InstanceStates are the instance states requests are approved in, empty allows any state.
+	InstanceStates []string
+	// InstanceSelector is a label selector the instance must match, e.g. k8s-cluster=main. Empty selects every instance.
+	InstanceSelector string
+	// InstanceGroups are the groups one of which the instance must belong to, empty allows instances outside of groups.
+	InstanceGroups []string
+
+	// BootstrapMaxInstanceAge is how long after creation an instance may bootstrap a kubelet client certificate,
+	// zero disables the check.
+	BootstrapMaxInstanceAge time.Duration
+
+	// DryRun verifies requests but only logs and annotates the decision instead of approving or denying.
+	DryRun bool
+
+	// AuditSink receives a record of every decision, nil disables the audit log.
+	AuditSink AuditSink
+	// Health receives the state reported by the liveness and readiness probes, nil uses a checker nobody probes.
+	Health *health.Checker
+
+	// Workers is the number of requests processed in parallel.
+	Workers int
+	// RetryBaseDelay and RetryMaxDelay bound the per-request exponential backoff
+	// applied when a request is abstained or its approval update fails.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// MaxRetries is how many times a request is retried before it is left pending, zero retries forever.
+	MaxRetries int
+}
+
 type controller struct {
 	k8s   k8s
 	cloud cloud
 
-	rInstanceName *regexp.Regexp
+	rInstanceName    *regexp.Regexp
+	lookup           Lookup
+	instanceStates   []string
+	instanceSelector labels.Selector
+	instanceGroups   []string
+	signers          map[string]policy
+	workers          int
+	maxRetries       int
+
+	nodeGroups      []string
+	bootstrapGroups []string
+	servingRules    []rule
+	clientRules     []rule
+	maxInstanceAge  time.Duration
+	dnsSuffixes     []string
+	dryRun          bool
+	auditSink       AuditSink
+	health          *health.Checker
+
+	// queue holds names of pending requests, requests holds their latest known version.
+	queue    workqueue.RateLimitingInterface
+	requests sync.Map
+
+	// ctx is cancelled by Abort to interrupt in-flight calls.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu orders Start subscribing to requests against Stop closing the subscription.
+	mu       sync.Mutex
+	stopping bool
+	started  bool
+	stopped  chan struct{}
 }
 
 func New(
 	k8s k8s,
 	cloud cloud,
 
-	instanceNameLayout string,
+	cfg Config,
 ) (ctrl *controller, err error) {
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("workers count must be positive, got %d", cfg.Workers)
+	}
+
 	ctrl = &controller{
-		k8s:   k8s,
-		cloud: cloud,
+		k8s:     k8s,
+		cloud:   cloud,
+		workers: cfg.Workers,
+
+		nodeGroups:      cfg.NodeGroups,
+		bootstrapGroups: cfg.BootstrapGroups,
+		maxInstanceAge:  cfg.BootstrapMaxInstanceAge,
+		maxRetries:      cfg.MaxRetries,
+		dnsSuffixes:     cfg.DNSSuffixes,
+		instanceStates:  cfg.InstanceStates,
+		instanceGroups:  cfg.InstanceGroups,
+		dryRun:          cfg.DryRun,
+		auditSink:       cfg.AuditSink,
+		health:          cfg.Health,
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(cfg.RetryBaseDelay, cfg.RetryMaxDelay),
+			"csr",
+		),
+		stopped: make(chan struct{}),
+	}
+	ctrl.ctx, ctrl.cancel = context.WithCancel(context.Background())
+	if ctrl.health == nil {
+		ctrl.health = health.New()
+	}
+
+	ctrl.signers, err = newSignerRegistry(cfg.Signers)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.lookup, err = parseLookup(cfg.InstanceLookup)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.instanceSelector, err = labels.Parse(cfg.InstanceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("parse instance selector: %w", err)
 	}
 
-	ctrl.rInstanceName, err = regexp.Compile(instanceNameLayout)
+	ctrl.servingRules, err = servingRules(cfg.KeyAlgorithms, cfg.MinRSAKeySize, cfg.MinECDSAKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.clientRules, err = clientRules(cfg.KeyAlgorithms, cfg.MinRSAKeySize, cfg.MinECDSAKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.rInstanceName, err = regexp.Compile(cfg.InstanceNameLayout)
 	return ctrl, err
 }
 
+// Start subscribes to requests and processes them in the background until Stop or Abort,
+// Done is closed when it has finished. Once Start has returned, Stop waits for the processing to finish.
+// Start does nothing after Stop.
 func (s *controller) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		close(s.stopped)
+		return nil
+	}
 	requestChan, err := s.k8s.CertificateSigningRequestsChan()
 	if err != nil {
 		return err
 	}
-	for r := range requestChan {
-		logger := zap.L().With(zap.String("name", r.Name))
-		logger.Debug("new_csr")
+	s.started = true
 
-		isVerification, err := s.verification(r, logger)
-		if err != nil {
-			logger.Error("verification request", zap.Error(err))
-		}
+	go func() {
+		defer close(s.stopped)
+		s.run(requestChan)
+	}()
+	return nil
+}
+
+// Done is closed when the processing started by Start has finished or Start was called after Stop.
+func (s *controller) Done() <-chan struct{} {
+	return s.stopped
+}
+
+func (s *controller) run(requestChan <-chan Event) {
+	s.health.SetActive(true)
+	defer s.health.SetActive(false)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		if isVerification {
-			logger.Debug("approve_request")
-			err := s.k8s.Approve(ctx, r)
-			if err != nil {
-				logger.Error("approve_request", zap.Error(err))
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s.processNext() {
 			}
-		} else {
-			logger.Debug("deny_request")
-			err := s.k8s.Deny(ctx, r)
-			if err != nil {
-				logger.Error("deny_request", zap.Error(err))
+		}()
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	s.health.IntakeHeartbeat(0)
+
+intake:
+	for {
+		select {
+		case r, ok := <-requestChan:
+			if !ok {
+				break intake
 			}
+			s.enqueue(r)
+		case <-heartbeat.C:
 		}
-		cancel()
+		s.health.IntakeHeartbeat(s.queue.Len())
 	}
-	return nil
+
+	// Requests already taken by workers are finished, queued ones are still handed out until the queue is empty.
+	s.queue.ShutDownWithDrain()
+	wg.Wait()
 }
 
+// enqueue queues a pending request of a handled signer and forgets a deleted one.
+func (s *controller) enqueue(r Event) {
+	logger := zap.L().With(zap.String("name", r.Name), zap.String("signer", r.Spec.SignerName))
+	logger.Debug("new_csr")
+	metrics.RequestsSeen.WithLabelValues(r.Spec.SignerName).Inc()
+
+	if r.DeletionTimestamp != nil {
+		logger.Debug("skip_csr", zap.String("reason", "request is deleted"))
+		s.requests.Delete(r.Name)
+		s.queue.Forget(r.Name)
+		return
+	}
+
+	if _, ok := s.signers[r.Spec.SignerName]; !ok {
+		logger.Debug("skip_csr", zap.String("reason", "signer is not handled"))
+		return
+	}
+
+	if state := getRequestState(r); state != statePending {
+		logger.Debug("skip_csr", zap.String("state", string(state)))
+		s.requests.Delete(r.Name)
+		return
+	}
+
+	// A known request is queued or waits for a retry, resyncs and its own updates must not skip the backoff.
+	if _, known := s.requests.LoadOrStore(r.Name, (*v1.CertificateSigningRequest)(r)); known {
+		s.requests.Store(r.Name, (*v1.CertificateSigningRequest)(r))
+		s.queue.AddRateLimited(r.Name)
+		return
+	}
+	s.queue.Add(r.Name)
+}
+
+// Stop closes the request stream and waits for Start to drain the queue.
 func (s *controller) Stop() {
+	s.mu.Lock()
+	s.stopping = true
+	started := s.started
+	s.mu.Unlock()
+
 	s.k8s.Stop()
+	if started {
+		<-s.stopped
+	}
+}
+
+// Abort stops without draining the queue: in-flight calls are cancelled and queued requests are dropped,
+// so no decision is made after another replica may have taken over.
+func (s *controller) Abort() {
+	s.cancel()
+	s.Stop()
 }
 
-func (s *controller) verification(req *v1.CertificateSigningRequest, logger *zap.Logger) (bool, error) {
+// processNext handles one request from the queue and reports whether the queue is still running.
+func (s *controller) processNext() bool {
+	key, shutdown := s.queue.Get()
+	if shutdown {
+		return false
+	}
+	s.health.WorkerHeartbeat()
+	defer s.queue.Done(key)
+	if s.ctx.Err() != nil {
+		return false
+	}
+	defer s.health.StartProcessing()()
+
+	name := key.(string)
+	value, ok := s.requests.Load(name)
+	if !ok {
+		s.queue.Forget(key)
+		return true
+	}
+	r := value.(*v1.CertificateSigningRequest)
+
+	logger := zap.L().With(zap.String("name", r.Name), zap.String("signer", r.Spec.SignerName))
+
+	d := s.signers[r.Spec.SignerName](s, r, logger)
+	if s.dryRun && d.verdict != verdictAbstain && dryRunRecorded(r, d) {
+		// The annotation patch and resyncs deliver the request again, its decision is counted once.
+		logger.Debug("skip_csr", zap.String("reason", "dry-run decision is already recorded"))
+		s.queue.Forget(key)
+		s.requests.Delete(name)
+		return true
+	}
+	metrics.Decisions.WithLabelValues(r.Spec.SignerName, string(d.verdict), d.reason, strconv.FormatBool(s.dryRun)).Inc()
+
+	if s.auditSink != nil {
+		if err := s.auditSink.Write(newAuditRecord(r, d, s.dryRun)); err != nil {
+			logger.Error("audit", zap.Error(err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+
+	if s.dryRun {
+		s.recordDryRun(ctx, key, r, d, logger)
+		return true
+	}
+
+	switch d.verdict {
+	case verdictApprove:
+		logger.Debug("approve_request")
+		err := s.k8s.Approve(ctx, r, d.explanation())
+		if err != nil {
+			logger.Error("approve_request", zap.Error(err))
+			s.retry(key, r, d.reason, logger)
+			return true
+		}
+	case verdictDeny:
+		logger.Debug("deny_request", zap.String("reason", d.reason), zap.String("message", d.message))
+		err := s.k8s.Deny(ctx, r, d.explanation())
+		if err != nil {
+			logger.Error("deny_request", zap.Error(err))
+			s.retry(key, r, d.reason, logger)
+			return true
+		}
+	default:
+		logger.Warn("abstain_request", zap.String("reason", d.reason), zap.Error(d.err))
+		s.retry(key, r, d.reason, logger)
+		return true
+	}
+
+	s.queue.Forget(key)
+	s.requests.Delete(name)
+	return true
+}
+
+// recordDryRun logs and annotates the decision that would have been made, the request stays pending.
+func (s *controller) recordDryRun(ctx context.Context, key any, r *v1.CertificateSigningRequest, d decision, logger *zap.Logger) {
+	message := d.message
+	if d.err != nil {
+		message = d.err.Error()
+	}
+	logger.Info("dry_run", zap.String("decision", string(d.verdict)), zap.String("reason", d.reason), zap.String("message", message))
+
+	if dryRunRecorded(r, d) {
+		s.retry(key, r, d.reason, logger)
+		return
+	}
+	err := s.k8s.Annotate(ctx, r, map[string]string{
+		AnnotationDryRunDecision: string(d.verdict),
+		AnnotationDryRunReason:   d.reason,
+		AnnotationDryRunMessage:  message,
+	})
+	if err != nil {
+		logger.Error("annotate_request", zap.Error(err))
+		s.retry(key, r, d.reason, logger)
+		return
+	}
+
+	if d.verdict == verdictAbstain {
+		s.retry(key, r, d.reason, logger)
+		return
+	}
+	s.queue.Forget(key)
+	s.requests.Delete(r.Name)
+}
+
+// retry requeues the request with backoff. After maxRetries retries it gives up and leaves the request pending,
+// it is verified again when the watch delivers it next time.
+func (s *controller) retry(key any, r *v1.CertificateSigningRequest, reason string, logger *zap.Logger) {
+	if s.maxRetries > 0 && s.queue.NumRequeues(key) >= s.maxRetries {
+		logger.Warn("give_up_request", zap.String("reason", reason), zap.Int("retries", s.queue.NumRequeues(key)))
+		metrics.RetriesExhausted.WithLabelValues(r.Spec.SignerName, reason).Inc()
+		s.queue.Forget(key)
+		s.requests.Delete(r.Name)
+		return
+	}
+	s.queue.AddRateLimited(key)
+}
+
+// verifier makes the decision on a parsed request, recording the checks in ev.
+type verifier func(s *controller, req *v1.CertificateSigningRequest, csr *x509.CertificateRequest, ev *evaluation, logger *zap.Logger) decision
+
+func (s *controller) verification(req *v1.CertificateSigningRequest, logger *zap.Logger, verify verifier) decision {
 	csr, err := parseCertificateRequest(req.Spec.Request)
 	if err != nil {
-		return false, err
+		// The request may be meant for another approver of the signer, it is left to it.
+		return abstain(reasonInvalidRequest, err)
+	}
+
+	ev := &evaluation{csr: csr}
+	d := verify(s, req, csr, ev, logger)
+	d.nodeName = strings.TrimPrefix(csr.Subject.CommonName, nodeUserPrefix)
+	d.evaluation = ev
+	return d
+}
+
+func (s *controller) verifyServing(req *v1.CertificateSigningRequest, csr *x509.CertificateRequest, ev *evaluation, logger *zap.Logger) decision {
+	if err := s.checkRequester(req, csr.Subject.CommonName, false); !ev.check("requester", err == nil) {
+		logger.Debug("requester_check", zap.Error(err))
+		return deny(reasonRequesterMismatch, err.Error())
+	}
+
+	if violated := violations(s.servingRules, req, csr, ev); len(violated) > 0 {
+		logger.Debug("rules_check", zap.Strings("violated", violated))
+		return deny(reasonPolicyViolation, fmt.Sprintf("violated rules: %s", strings.Join(violated, ", ")))
 	}
 
 	virtualMachineName, err := s.getVirtualMachineName(csr.Subject.CommonName)
 	if err != nil {
-		return false, err
+		// A wrong INSTANCE_NAME_LAYOUT or a name meant for another approver must not deny requests.
+		return abstain(reasonInstanceNameMissing, err)
 	}
 
 	logger.Debug("verification", zap.Any("vm_name", virtualMachineName))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	nodeName := strings.TrimPrefix(csr.Subject.CommonName, nodeUserPrefix)
+	var node *corev1.Node
+	lookup, value := s.lookup, virtualMachineName
+	if s.lookup == LookupProviderID {
+		if node, err = s.getNode(nodeName); err != nil {
+			return abstain(reasonNodeError, err)
+		}
+		if node == nil || node.Spec.ProviderID == "" {
+			return abstain(reasonInstanceNameMissing, fmt.Errorf("node %s has no providerID yet", nodeName))
+		}
+		lookup, value = LookupID, providerInstanceID(node.Spec.ProviderID)
+	}
+
+	instance, d, ok := s.findInstance(lookup, value, ev, logger, func(instance *Instance) *denial {
+		if d := s.checkInstance(virtualMachineName, instance, ev); d != nil {
+			return d
+		}
+		return s.checkSANs(virtualMachineName, instance, csr, ev)
+	})
+	if !ok {
+		return d
+	}
+
+	if s.lookup != LookupProviderID {
+		if node, err = s.getNode(nodeName); err != nil {
+			return abstain(reasonNodeError, err)
+		}
+	}
+	if node != nil {
+		if d := checkNode(node, instance, csr, ev); d != nil {
+			logger.Debug("node_check", zap.String("reason", d.reason), zap.String("message", d.message))
+			return d.decision()
+		}
+	}
+	return approve(fmt.Sprintf("IP and DNS SANs belong to instance %s", virtualMachineName))
+}
+
+// verifyClient checks a kubelet client request: the instance named in the CommonName must exist
+// and must not be a different machine than a node already registered under that name.
+// Bootstrap identities may only request certificates for instances created recently.
+func (s *controller) verifyClient(req *v1.CertificateSigningRequest, csr *x509.CertificateRequest, ev *evaluation, logger *zap.Logger) decision {
+	if err := s.checkRequester(req, csr.Subject.CommonName, true); !ev.check("requester", err == nil) {
+		logger.Debug("requester_check", zap.Error(err))
+		return deny(reasonRequesterMismatch, err.Error())
+	}
+
+	if violated := violations(s.clientRules, req, csr, ev); len(violated) > 0 {
+		logger.Debug("rules_check", zap.Strings("violated", violated))
+		return deny(reasonPolicyViolation, fmt.Sprintf("violated rules: %s", strings.Join(violated, ", ")))
+	}
 
-	vmIPs, err := s.cloud.GetInstanceAddresses(ctx, virtualMachineName)
+	virtualMachineName, err := s.getVirtualMachineName(csr.Subject.CommonName)
 	if err != nil {
-		return false, err
+		// A wrong INSTANCE_NAME_LAYOUT or a name meant for another approver must not deny requests.
+		return abstain(reasonInstanceNameMissing, err)
 	}
 
-	for _, ip := range csr.IPAddresses {
-		if !ipIsExist(ip, vmIPs) {
-			logger.Debug("ip_check", zap.String("result", "ip is not found in vm ips"), zap.String("ip", ip.String()))
-			return false, nil
+	logger.Debug("verification", zap.Any("vm_name", virtualMachineName))
+
+	// A bootstrapping kubelet has no node yet, so the instance is found by name instead of providerID.
+	lookup := s.lookup
+	if lookup == LookupProviderID {
+		lookup = LookupName
+	}
+	bootstrap := !hasAnyGroup(req.Spec.Groups, s.nodeGroups)
+	instance, d, ok := s.findInstance(lookup, virtualMachineName, ev, logger, func(instance *Instance) *denial {
+		if d := s.checkInstance(virtualMachineName, instance, ev); d != nil {
+			return d
+		}
+		if bootstrap && s.maxInstanceAge > 0 {
+			return s.checkInstanceAge(virtualMachineName, instance, ev)
+		}
+		return nil
+	})
+	if !ok {
+		return d
+	}
+
+	nodeName := strings.TrimPrefix(csr.Subject.CommonName, nodeUserPrefix)
+	node, err := s.getNode(nodeName)
+	if err != nil {
+		return abstain(reasonNodeError, err)
+	}
+	if node != nil {
+		if d := checkNodeInstance(node, instance, ev); d != nil {
+			logger.Debug("node_check", zap.String("reason", d.reason), zap.String("message", d.message))
+			return d.decision()
 		}
 	}
-	return true, nil
+	return approve(fmt.Sprintf("instance %s may join as node %s", virtualMachineName, nodeName))
+}
+
+// findInstance gets the instance, records it in ev and runs checks on it.
+// Cached instance data may be stale, e.g. for an instance that was still starting, so failed checks are run again
+// on the instance looked up with fresh data and only the result on fresh data denies the request.
+// If the instance is not found the returned decision denies an ambiguous lookup or abstains on any other error.
+func (s *controller) findInstance(
+	lookup Lookup,
+	value string,
+	ev *evaluation,
+	logger *zap.Logger,
+	checks func(instance *Instance) *denial,
+) (*Instance, decision, bool) {
+	checked := len(ev.rules)
+	instance, d, ok := s.lookupInstance(lookup, value, false, ev)
+	if !ok {
+		return nil, d, false
+	}
+	failed := checks(instance)
+	if failed == nil {
+		return instance, decision{}, true
+	}
+
+	logger.Debug("instance_recheck", zap.String("reason", failed.reason), zap.String("message", failed.message))
+	ev.rules = ev.rules[:checked]
+	instance, d, ok = s.lookupInstance(lookup, value, true, ev)
+	if !ok {
+		return nil, d, false
+	}
+	if failed := checks(instance); failed != nil {
+		logger.Debug("instance_check", zap.String("reason", failed.reason), zap.String("message", failed.message))
+		return nil, failed.decision(), false
+	}
+	return instance, decision{}, true
+}
+
+func (s *controller) lookupInstance(lookup Lookup, value string, fresh bool, ev *evaluation) (*Instance, decision, bool) {
+	instance, err := s.getInstance(lookup, value, fresh)
+	if errors.Is(err, ErrAmbiguousInstance) {
+		return nil, deny(reasonAmbiguousInstance, err.Error()), false
+	}
+	if err != nil {
+		return nil, abstain(reasonCloudError, err), false
+	}
+	ev.instance = instance
+
+	if len(s.instanceGroups) > 0 && instance.Groups == nil {
+		return nil, abstain(reasonInstanceGroupsUnknown, fmt.Errorf("groups of instance %s are not resolved by the cloud provider", value)), false
+	}
+	return instance, decision{}, true
+}
+
+// getInstance looks the instance up in the cloud, recording latency and cloud health.
+// A fresh lookup asks the cloud to bypass its caches.
+func (s *controller) getInstance(lookup Lookup, value string, fresh bool) (*Instance, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	if fresh {
+		ctx = WithFreshData(ctx)
+	}
+
+	started := time.Now()
+	instance, err := s.cloud.GetInstance(ctx, lookup, value)
+	metrics.CloudRequestDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(started).Seconds())
+	if err == nil || errors.Is(err, ErrInstanceNotFound) || errors.Is(err, ErrAmbiguousInstance) {
+		s.health.ObserveCloudCall(nil)
+	} else {
+		s.health.ObserveCloudCall(err)
+	}
+	return instance, err
 }
 
 func (s *controller) getVirtualMachineName(str string) (string, error) {
@@ -139,3 +678,27 @@ func ipIsExist(ip net.IP, ips []net.IP) bool {
 	}
 	return false
 }
+
+// dnsNameIsExist reports whether name is one of hostnames, optionally qualified with one of suffixes.
+func dnsNameIsExist(name string, hostnames, suffixes []string) bool {
+	name = normalizeDNSName(name)
+	for _, h := range hostnames {
+		h = normalizeDNSName(h)
+		if h == "" {
+			continue
+		}
+		if name == h {
+			return true
+		}
+		for _, suffix := range suffixes {
+			if name == h+"."+normalizeDNSName(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
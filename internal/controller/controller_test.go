@@ -1,24 +1,41 @@
 package controller_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/fraima/cluster-machine-approver/internal/controller"
+	"github.com/fraima/cluster-machine-approver/internal/health"
 	"github.com/fraima/cluster-machine-approver/internal/mocks"
 )
 
 var (
 	nilError error
+
+	testSigners = map[string]string{
+		v1.KubeletServingSignerName: controller.PolicyServing,
+	}
 )
 
 func TestApprove(t *testing.T) {
@@ -40,8 +57,10 @@ func TestApprove(t *testing.T) {
 	k8sMock.On("CertificateSigningRequestsChan").
 		Return(certificateSigningRequestsOutChan, nilError)
 
-	k8sMock.On("Approve", testCertificateSigningRequest).
+	k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
 		Return(nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
 
 	cloudMock := mocks.NewCloud(t)
 
@@ -52,23 +71,21 @@ func TestApprove(t *testing.T) {
 		net.ParseIP("126.126.126.126"),
 	}
 
-	cloudMock.On("GetInstanceAddresses", testVirtualMachineName).
-		Return(testApproveIPSet, nilError)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(&controller.Instance{Addresses: testApproveIPSet}, nilError)
 
 	ctrl, err := controller.New(
 		k8sMock,
 		cloudMock,
-		testRegexp,
+		testConfig(testRegexp),
 	)
 	require.NoError(t, err)
 
-	go func() {
-		err = ctrl.Start()
-		require.NoError(t, err)
-	}()
+	require.NoError(t, ctrl.Start())
 	certificateSigningRequestsChan <- testCertificateSigningRequest
 
 	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
 }
 
 func TestDeny(t *testing.T) {
@@ -89,7 +106,11 @@ func TestDeny(t *testing.T) {
 
 	k8sMock.On("CertificateSigningRequestsChan").
 		Return(certificateSigningRequestsOutChan, nilError)
-	k8sMock.On("Deny", testCertificateSigningRequest).
+	k8sMock.On("Deny", testCertificateSigningRequest, controller.Explanation{
+		NodeName: testVirtualMachineName,
+		Reason:   "IPNotFound",
+		Message:  "IP 126.126.126.126 is not an address of instance test-virtual-name",
+	}).
 		Return(nilError)
 
 	cloudMock := mocks.NewCloud(t)
@@ -100,23 +121,58 @@ func TestDeny(t *testing.T) {
 		net.ParseIP("125.125.125.125"),
 	}
 
-	cloudMock.On("GetInstanceAddresses", testVirtualMachineName).
-		Return(testDenyIPSet, nilError)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(&controller.Instance{Addresses: testDenyIPSet}, nilError)
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestAmbiguousInstance(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testCertificateSigningRequest := testCSR(t, testCommonName, []net.IP{net.ParseIP("123.123.123.123")})
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Deny", testCertificateSigningRequest, controller.Explanation{
+		NodeName: testVirtualMachineName,
+		Reason:   "AmbiguousInstance",
+		Message:  "found in 2 folders: instance is ambiguous",
+	}).
+		Return(nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(nil, fmt.Errorf("found in 2 folders: %w", controller.ErrAmbiguousInstance))
 
 	ctrl, err := controller.New(
 		k8sMock,
 		cloudMock,
-		testRegexp,
+		testConfig(testRegexp),
 	)
 	require.NoError(t, err)
 
-	go func() {
-		err = ctrl.Start()
-		require.NoError(t, err)
-	}()
+	require.NoError(t, ctrl.Start())
 	certificateSigningRequestsChan <- testCertificateSigningRequest
 
 	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
 }
 
 func TestWorkflow(t *testing.T) {
@@ -143,11 +199,11 @@ func TestWorkflow(t *testing.T) {
 
 	cloudMock := mocks.NewCloud(t)
 
-	cloudMock.On("GetInstanceAddresses", testVirtualMachineApproveName).
-		Return(testIPSetApprove, nilError)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineApproveName).
+		Return(&controller.Instance{Addresses: testIPSetApprove}, nilError)
 
-	cloudMock.On("GetInstanceAddresses", testVirtualMachineDenyName).
-		Return(testIPSetApprove, nilError)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineDenyName).
+		Return(&controller.Instance{Addresses: testIPSetApprove}, nilError)
 
 	k8sMock := mocks.NewK8s(t)
 	certificateSigningRequestsChan := make(chan controller.Event)
@@ -155,22 +211,21 @@ func TestWorkflow(t *testing.T) {
 
 	k8sMock.On("CertificateSigningRequestsChan").
 		Return(certificateSigningRequestsOutChan, nilError)
-	k8sMock.On("Deny", testCertificateSigningRequestDeny).
+	k8sMock.On("Deny", testCertificateSigningRequestDeny, mock.Anything).
 		Return(nilError)
-	k8sMock.On("Approve", testCertificateSigningRequestApprove).
+	k8sMock.On("Approve", testCertificateSigningRequestApprove, mock.Anything).
 		Return(nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
 
 	ctrl, err := controller.New(
 		k8sMock,
 		cloudMock,
-		testRegexp,
+		testConfig(testRegexp),
 	)
 	require.NoError(t, err)
 
-	go func() {
-		err = ctrl.Start()
-		require.NoError(t, err)
-	}()
+	require.NoError(t, ctrl.Start())
 	certificateSigningRequestsChan <- testCertificateSigningRequestApprove
 	certificateSigningRequestsChan <- testCertificateSigningRequestDeny
 
@@ -182,30 +237,1565 @@ func TestWorkflow(t *testing.T) {
 	certificateSigningRequestsChan <- testCertificateSigningRequestApprove
 
 	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
 }
 
-func testCSR(t *testing.T, testCommonName string, testIPSet []net.IP) *v1.CertificateSigningRequest {
-	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+func TestAbstain(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+
+	retried := make(chan struct{})
+	var calls int
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(nil, errors.New("cloud is unavailable")).
+		Run(func(mock.Arguments) {
+			calls++
+			if calls == 2 {
+				close(retried)
+			}
+		})
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
 	require.NoError(t, err)
 
-	template := x509.CertificateRequest{
-		Subject: pkix.Name{
-			CommonName: testCommonName,
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	select {
+	case <-retried:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abstained request is not retried")
+	}
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestDeletedRequest(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+
+	retried := make(chan struct{})
+	var calls int32
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(nil, errors.New("cloud is unavailable")).
+		Run(func(mock.Arguments) {
+			if atomic.AddInt32(&calls, 1) == 2 {
+				close(retried)
+			}
+		})
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	select {
+	case <-retried:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abstained request is not retried")
+	}
+
+	deleted := testCertificateSigningRequest.DeepCopy()
+	deleted.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	certificateSigningRequestsChan <- deleted
+
+	// A retry already in flight may still finish, after it the deleted request is not retried anymore.
+	time.Sleep(50 * time.Millisecond)
+	seen := atomic.LoadInt32(&calls)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, seen, atomic.LoadInt32(&calls))
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestResyncKeepsBackoff(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	looked := make(chan struct{})
+	var calls int32
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(nil, errors.New("cloud is unavailable")).
+		Run(func(mock.Arguments) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(looked)
+			}
+		})
+
+	cfg := testConfig(testRegexp)
+	cfg.RetryBaseDelay = time.Hour
+	cfg.RetryMaxDelay = time.Hour
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+	<-looked
+
+	// Resyncs deliver the request waiting for its retry again, it is not looked up before the backoff expires.
+	certificateSigningRequestsChan <- testCertificateSigningRequest.DeepCopy()
+	certificateSigningRequestsChan <- testCertificateSigningRequest.DeepCopy()
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRetryLimit(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	var calls int32
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(nil, fmt.Errorf("instance %s: %w", testVirtualMachineName, controller.ErrInstanceNotFound)).
+		Run(func(mock.Arguments) {
+			atomic.AddInt32(&calls, 1)
+		})
+
+	cfg := testConfig(testRegexp)
+	cfg.MaxRetries = 2
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	// The first attempt and two retries, then the request is left pending.
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 3
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestInstanceNameNotMatched(t *testing.T) {
+	testRegexp := "system:node:(cluster-.[^ ]*)"
+	testCommonName := "system:node:test-virtual-name"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	tests := []struct {
+		name        string
+		username    string
+		explanation *controller.Explanation
+	}{
+		{
+			name:     "node",
+			username: testCommonName,
+		},
+		{
+			name:     "another node",
+			username: "system:node:other-virtual-name",
+			explanation: &controller.Explanation{
+				NodeName: "test-virtual-name",
+				Reason:   "RequesterMismatch",
+				Message:  `requester "system:node:other-virtual-name" may not request a certificate for "system:node:test-virtual-name"`,
+			},
 		},
-		IPAddresses: testIPSet,
 	}
 
-	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, pk)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+			testCertificateSigningRequest.Spec.Username = tt.username
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			// A name the layout does not match is left pending, only the requester check denies.
+			if tt.explanation != nil {
+				k8sMock.On("Deny", testCertificateSigningRequest, *tt.explanation).
+					Return(nilError)
+			}
+
+			ctrl, err := controller.New(
+				k8sMock,
+				mocks.NewCloud(t),
+				testConfig(testRegexp),
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestSkipNotPending(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testCommonName := "system:node:test-virtual-name"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	condition := func(conditionType v1.RequestConditionType) v1.CertificateSigningRequestCondition {
+		return v1.CertificateSigningRequestCondition{
+			Type:   conditionType,
+			Status: corev1.ConditionTrue,
+		}
+	}
+
+	approved := testCSR(t, testCommonName, testIPSet)
+	approved.Status.Conditions = []v1.CertificateSigningRequestCondition{condition(v1.CertificateApproved)}
+
+	denied := testCSR(t, testCommonName, testIPSet)
+	denied.Status.Conditions = []v1.CertificateSigningRequestCondition{condition(v1.CertificateDenied)}
+
+	failed := testCSR(t, testCommonName, testIPSet)
+	failed.Status.Conditions = []v1.CertificateSigningRequestCondition{
+		condition(v1.CertificateApproved),
+		condition(v1.CertificateFailed),
+	}
+
+	issued := testCSR(t, testCommonName, testIPSet)
+	issued.Status.Conditions = []v1.CertificateSigningRequestCondition{condition(v1.CertificateApproved)}
+	issued.Status.Certificate = []byte("certificate")
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
 	require.NoError(t, err)
 
-	return &v1.CertificateSigningRequest{
-		Spec: v1.CertificateSigningRequestSpec{
-			Request: pem.EncodeToMemory(
-				&pem.Block{
-					Type:  "CERTIFICATE REQUEST",
-					Bytes: csr,
-				},
-			),
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- approved
+	certificateSigningRequestsChan <- denied
+	certificateSigningRequestsChan <- failed
+	certificateSigningRequestsChan <- issued
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestSkipUnknownSigner(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testCertificateSigningRequest := testCSR(t, "system:node:test-virtual-name", []net.IP{
+		net.ParseIP("123.123.123.123"),
+	})
+	testCertificateSigningRequest.Spec.SignerName = "example.com/serving"
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	cfg := testConfig("system:node:(.[^ ]*)")
+	cfg.Signers = map[string]string{
+		v1.KubeletServingSignerName: "unknown",
+	}
+
+	_, err := controller.New(
+		mocks.NewK8s(t),
+		mocks.NewCloud(t),
+		cfg,
+	)
+	require.ErrorContains(t, err, "unknown policy")
+}
+
+func TestRequesterIdentity(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	tests := []struct {
+		name       string
+		signerName string
+		username   string
+		groups     []string
+		approve    bool
+	}{
+		{
+			name:       "node requests its own serving certificate",
+			signerName: v1.KubeletServingSignerName,
+			username:   testCommonName,
+			groups:     []string{"system:nodes"},
+			approve:    true,
+		},
+		{
+			name:       "node requests serving certificate of another node",
+			signerName: v1.KubeletServingSignerName,
+			username:   "system:node:other-virtual-name",
+			groups:     []string{"system:nodes"},
+		},
+		{
+			name:       "requester is not a node",
+			signerName: v1.KubeletServingSignerName,
+			username:   testCommonName,
+			groups:     []string{"system:authenticated"},
+		},
+		{
+			name:       "bootstrapper requests serving certificate",
+			signerName: v1.KubeletServingSignerName,
+			username:   "system:bootstrap:abcdef",
+			groups:     []string{"system:bootstrappers"},
+		},
+		{
+			name:       "bootstrapper requests client certificate verified as serving",
+			signerName: v1.KubeAPIServerClientKubeletSignerName,
+			username:   "system:bootstrap:abcdef",
+			groups:     []string{"system:bootstrappers"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+			testCertificateSigningRequest.Spec.SignerName = tt.signerName
+			testCertificateSigningRequest.Spec.Username = tt.username
+			testCertificateSigningRequest.Spec.Groups = tt.groups
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+
+			cloudMock := mocks.NewCloud(t)
+			if tt.approve {
+				cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+					Return(&controller.Instance{Addresses: testIPSet}, nilError)
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+				k8sMock.On("GetNode", mock.Anything).
+					Return(nil, nilError)
+			} else {
+				k8sMock.On("Deny", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+			}
+
+			cfg := testConfig(testRegexp)
+			cfg.Signers = map[string]string{
+				v1.KubeletServingSignerName:             controller.PolicyServing,
+				v1.KubeAPIServerClientKubeletSignerName: controller.PolicyServing,
+			}
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				cfg,
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestContentRules(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testCommonName := "system:node:test-virtual-name"
+
+	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	testCertificateSigningRequest := testCSRFromTemplate(t, x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   testCommonName,
+			Organization: []string{"system:masters"},
+		},
+		EmailAddresses: []string{"node@example.com"},
+	}, pk)
+	testCertificateSigningRequest.Spec.Usages = []v1.KeyUsage{
+		v1.UsageDigitalSignature,
+		v1.UsageClientAuth,
+	}
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Deny", testCertificateSigningRequest, controller.Explanation{
+		NodeName: "test-virtual-name",
+		Reason:   "PolicyViolation",
+		Message:  "violated rules: required_usages, allowed_usages, organization, no_email_sans, dns_or_ip_san, key_size",
+	}).
+		Return(nilError)
+
+	cloudMock := mocks.NewCloud(t)
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestServingCommonName(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testCommonName := "system:node:"
+	testCertificateSigningRequest := testCSR(t, testCommonName, []net.IP{
+		net.ParseIP("123.123.123.123"),
+	})
+	testCertificateSigningRequest.Spec.Username = testCommonName
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Deny", testCertificateSigningRequest, controller.Explanation{
+		Reason:  "PolicyViolation",
+		Message: "violated rules: common_name",
+	}).
+		Return(nilError)
+
+	ctrl, err := controller.New(
+		k8sMock,
+		mocks.NewCloud(t),
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestDNSNames(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testInstance := &controller.Instance{
+		Addresses: []net.IP{
+			net.ParseIP("123.123.123.123"),
+		},
+		Hostnames: []string{
+			"test-virtual-name.ru-central1.internal",
+			"test-virtual-name",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		dnsNames []string
+		approve  bool
+	}{
+		{
+			name:     "fqdn and hostname",
+			dnsNames: []string{"test-virtual-name", "Test-Virtual-Name.ru-central1.internal."},
+			approve:  true,
+		},
+		{
+			name:     "hostname with allowed suffix",
+			dnsNames: []string{"test-virtual-name.cluster.local"},
+			approve:  true,
+		},
+		{
+			name:     "hostname with unknown suffix",
+			dnsNames: []string{"test-virtual-name.example.com"},
+		},
+		{
+			name:     "hostname of another instance",
+			dnsNames: []string{"test-virtual-name", "other-virtual-name"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.NoError(t, err)
+
+			testCertificateSigningRequest := testCSRFromTemplate(t, x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName:   testCommonName,
+					Organization: []string{"system:nodes"},
+				},
+				DNSNames: tt.dnsNames,
+			}, pk)
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			if tt.approve {
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+				k8sMock.On("GetNode", mock.Anything).
+					Return(nil, nilError)
+			} else {
+				k8sMock.On("Deny", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+			}
+
+			cloudMock := mocks.NewCloud(t)
+			cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+				Return(testInstance, nilError)
+
+			cfg := testConfig(testRegexp)
+			cfg.DNSSuffixes = []string{"cluster.local"}
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				cfg,
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestNodeCrossCheck(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testInstance := &controller.Instance{
+		ID:        "test-instance-id",
+		Addresses: testIPSet,
+		Hostnames: []string{testVirtualMachineName},
+	}
+
+	tests := []struct {
+		name        string
+		node        *corev1.Node
+		explanation *controller.Explanation
+	}{
+		{
+			name: "same instance",
+			node: testNode(testVirtualMachineName, "yandex://test-instance-id", corev1.NodeAddress{
+				Type:    corev1.NodeInternalIP,
+				Address: "123.123.123.123",
+			}, corev1.NodeAddress{
+				Type:    corev1.NodeHostName,
+				Address: testVirtualMachineName,
+			}),
+		},
+		{
+			name: "provider id and addresses are not set yet",
+			node: testNode(testVirtualMachineName, ""),
+		},
+		{
+			name: "recycled instance name",
+			node: testNode(testVirtualMachineName, "yandex://old-instance-id"),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "ProviderIDMismatch",
+				Message:  "node test-virtual-name has providerID yandex://old-instance-id, but the instance is test-instance-id",
+			},
+		},
+		{
+			name: "reused address",
+			node: testNode(testVirtualMachineName, "yandex://test-instance-id", corev1.NodeAddress{
+				Type:    corev1.NodeInternalIP,
+				Address: "124.124.124.124",
+			}),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "NodeAddressMismatch",
+				Message:  "IP 123.123.123.123 is not an address of node test-virtual-name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.NoError(t, err)
+
+			testCertificateSigningRequest := testCSRFromTemplate(t, x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName:   testCommonName,
+					Organization: []string{"system:nodes"},
+				},
+				IPAddresses: testIPSet,
+				DNSNames:    []string{testVirtualMachineName},
+			}, pk)
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			k8sMock.On("GetNode", testVirtualMachineName).
+				Return(tt.node, nilError)
+			if tt.explanation == nil {
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+			} else {
+				k8sMock.On("Deny", testCertificateSigningRequest, *tt.explanation).
+					Return(nilError)
+			}
+
+			cloudMock := mocks.NewCloud(t)
+			cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+				Return(testInstance, nilError)
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				testConfig(testRegexp),
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestProviderIDLookup(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("GetNode", testVirtualMachineName).
+		Return(testNode(testVirtualMachineName, "yandex://test-instance-id"), nilError).
+		Once()
+	k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+		Return(nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupID, "test-instance-id").
+		Return(&controller.Instance{ID: "test-instance-id", Addresses: testIPSet}, nilError)
+
+	cfg := testConfig(testRegexp)
+	cfg.InstanceLookup = controller.LookupProviderID
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestUnknownLookup(t *testing.T) {
+	cfg := testConfig("system:node:(.[^ ]*)")
+	cfg.InstanceLookup = "hostname"
+
+	_, err := controller.New(mocks.NewK8s(t), mocks.NewCloud(t), cfg)
+	require.Error(t, err)
+}
+
+func TestInstanceChecks(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	tests := []struct {
+		name        string
+		status      string
+		labels      map[string]string
+		groups      []string
+		abstain     bool
+		explanation *controller.Explanation
+	}{
+		{
+			name:   "running instance of the cluster",
+			status: "RUNNING",
+			labels: map[string]string{"k8s-cluster": "main", "role": "worker"},
+			groups: []string{"instance-group-id", "node-group-id"},
+		},
+		{
+			name:   "stopped instance",
+			status: "STOPPED",
+			labels: map[string]string{"k8s-cluster": "main"},
+			groups: []string{"node-group-id"},
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceStateNotAllowed",
+				Message:  "instance test-virtual-name is STOPPED, allowed states are [RUNNING]",
+			},
+		},
+		{
+			name:   "instance of another cluster",
+			status: "RUNNING",
+			labels: map[string]string{"k8s-cluster": "other"},
+			groups: []string{"node-group-id"},
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceNotSelected",
+				Message:  "instance test-virtual-name labels map[k8s-cluster:other] do not match selector k8s-cluster=main",
+			},
+		},
+		{
+			name:   "instance created by hand",
+			status: "RUNNING",
+			labels: map[string]string{"k8s-cluster": "main"},
+			groups: []string{},
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceGroupNotAllowed",
+				Message:  "instance test-virtual-name is in groups [], none of them is allowed",
+			},
+		},
+		{
+			name:   "instance of another node group",
+			status: "RUNNING",
+			labels: map[string]string{"k8s-cluster": "main"},
+			groups: []string{"other-instance-group-id", "other-node-group-id"},
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceGroupNotAllowed",
+				Message:  "instance test-virtual-name is in groups [other-instance-group-id other-node-group-id], none of them is allowed",
+			},
+		},
+		{
+			name:    "groups are not resolved",
+			status:  "RUNNING",
+			labels:  map[string]string{"k8s-cluster": "main"},
+			abstain: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			switch {
+			case tt.abstain:
+			case tt.explanation == nil:
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+				k8sMock.On("GetNode", mock.Anything).
+					Return(nil, nilError)
+			default:
+				k8sMock.On("Deny", testCertificateSigningRequest, *tt.explanation).
+					Return(nilError)
+			}
+
+			cloudMock := mocks.NewCloud(t)
+			cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+				Return(&controller.Instance{Addresses: testIPSet, Status: tt.status, Labels: tt.labels, Groups: tt.groups}, nilError)
+
+			cfg := testConfig(testRegexp)
+			cfg.InstanceStates = []string{"RUNNING"}
+			cfg.InstanceSelector = "k8s-cluster=main"
+			cfg.InstanceGroups = []string{"node-group-id"}
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				cfg,
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestInstanceRecheck(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	tests := []struct {
+		name        string
+		fresh       *controller.Instance
+		explanation *controller.Explanation
+	}{
+		{
+			name:  "instance has started since it was cached",
+			fresh: &controller.Instance{Addresses: testIPSet, Status: "RUNNING"},
+		},
+		{
+			name:  "instance is still starting",
+			fresh: &controller.Instance{Addresses: testIPSet, Status: "STARTING"},
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceStateNotAllowed",
+				Message:  "instance test-virtual-name is STARTING, allowed states are [RUNNING]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			if tt.explanation == nil {
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+				k8sMock.On("GetNode", mock.Anything).
+					Return(nil, nilError)
+			} else {
+				k8sMock.On("Deny", testCertificateSigningRequest, *tt.explanation).
+					Return(nilError)
+			}
+
+			// The cached instance fails the checks, so it is looked up again with fresh data.
+			cloudMock := mocks.NewCloud(t)
+			cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+				Return(&controller.Instance{Addresses: testIPSet, Status: "PROVISIONING"}, nilError).
+				Once()
+			cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+				Return(tt.fresh, nilError).
+				Once()
+
+			cfg := testConfig(testRegexp)
+			cfg.InstanceStates = []string{"RUNNING"}
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				cfg,
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestBootstrapClient(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	bootstrapper := []string{"system:bootstrappers", "system:authenticated"}
+
+	tests := []struct {
+		name        string
+		groups      []string
+		dnsNames    []string
+		createdAt   time.Time
+		node        *corev1.Node
+		explanation *controller.Explanation
+	}{
+		{
+			name:      "fresh instance",
+			groups:    bootstrapper,
+			createdAt: time.Now().Add(-10 * time.Minute),
+		},
+		{
+			name:      "fresh instance rejoins with its node",
+			groups:    bootstrapper,
+			createdAt: time.Now().Add(-10 * time.Minute),
+			node:      testNode(testVirtualMachineName, "yandex://test-instance-id"),
+		},
+		{
+			name:      "old instance",
+			groups:    bootstrapper,
+			createdAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceTooOld",
+				Message:  "instance test-virtual-name was created at 2022-01-01T00:00:00Z, bootstrap is allowed for 1h0m0s after creation",
+			},
+		},
+		{
+			name:   "unknown creation time",
+			groups: bootstrapper,
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "InstanceTooOld",
+				Message:  "creation time of instance test-virtual-name is unknown",
+			},
+		},
+		{
+			name:      "node registered by another instance",
+			groups:    bootstrapper,
+			createdAt: time.Now().Add(-10 * time.Minute),
+			node:      testNode(testVirtualMachineName, "yandex://other-instance-id"),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "ProviderIDMismatch",
+				Message:  "node test-virtual-name has providerID yandex://other-instance-id, but the instance is test-instance-id",
+			},
+		},
+		{
+			name:      "node without providerID registered from another address",
+			groups:    bootstrapper,
+			createdAt: time.Now().Add(-10 * time.Minute),
+			node: testNode(testVirtualMachineName, "",
+				corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+			),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "NodeAddressMismatch",
+				Message:  "node test-virtual-name is registered with addresses [10.0.0.1], none of them belongs to the instance",
+			},
+		},
+		{
+			name:      "node renews its client certificate",
+			groups:    []string{"system:nodes", "system:authenticated"},
+			createdAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+			node:      testNode(testVirtualMachineName, "yandex://test-instance-id"),
+		},
+		{
+			name:      "request with SANs",
+			groups:    bootstrapper,
+			dnsNames:  []string{"test-virtual-name"},
+			createdAt: time.Now().Add(-10 * time.Minute),
+			explanation: &controller.Explanation{
+				NodeName: testVirtualMachineName,
+				Reason:   "PolicyViolation",
+				Message:  "violated rules: no_sans",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCertificateSigningRequest := testClientCSR(t, testVirtualMachineName, tt.dnsNames)
+			testCertificateSigningRequest.Spec.Groups = tt.groups
+			if tt.groups[0] == "system:bootstrappers" {
+				testCertificateSigningRequest.Spec.Username = "system:bootstrap:abcdef"
+			}
+
+			k8sMock := mocks.NewK8s(t)
+			certificateSigningRequestsChan := make(chan controller.Event)
+			var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+			k8sMock.On("CertificateSigningRequestsChan").
+				Return(certificateSigningRequestsOutChan, nilError)
+			if tt.explanation == nil {
+				k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+					Return(nilError)
+			} else {
+				k8sMock.On("Deny", testCertificateSigningRequest, *tt.explanation).
+					Return(nilError)
+			}
+
+			cloudMock := mocks.NewCloud(t)
+			if tt.dnsNames == nil {
+				cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+					Return(&controller.Instance{ID: "test-instance-id", Addresses: testIPSet, CreatedAt: tt.createdAt}, nilError)
+			}
+			if tt.dnsNames == nil && (tt.explanation == nil || tt.explanation.Reason != "InstanceTooOld") {
+				k8sMock.On("GetNode", testVirtualMachineName).
+					Return(tt.node, nilError)
+			}
+
+			cfg := testConfig(testRegexp)
+			cfg.Signers = map[string]string{
+				v1.KubeAPIServerClientKubeletSignerName: controller.PolicyClient,
+			}
+			cfg.BootstrapMaxInstanceAge = time.Hour
+
+			ctrl, err := controller.New(
+				k8sMock,
+				cloudMock,
+				cfg,
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, ctrl.Start())
+			certificateSigningRequestsChan <- testCertificateSigningRequest
+
+			close(certificateSigningRequestsChan)
+			<-ctrl.Done()
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	testVirtualMachineApproveName := "test-approve-virtual-name"
+	testCertificateSigningRequestApprove := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineApproveName), testIPSet)
+
+	testVirtualMachineDenyName := "test-deny-virtual-name"
+	testCertificateSigningRequestDeny := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineDenyName), testIPSet)
+
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineApproveName).
+		Return(&controller.Instance{Addresses: testIPSet}, nilError)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineDenyName).
+		Return(&controller.Instance{}, nilError)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
+	k8sMock.On("Annotate", testCertificateSigningRequestApprove, map[string]string{
+		controller.AnnotationDryRunDecision: "approve",
+		controller.AnnotationDryRunReason:   "InstanceVerified",
+		controller.AnnotationDryRunMessage:  "IP and DNS SANs belong to instance test-approve-virtual-name",
+	}).
+		Return(nilError)
+	k8sMock.On("Annotate", testCertificateSigningRequestDeny, map[string]string{
+		controller.AnnotationDryRunDecision: "deny",
+		controller.AnnotationDryRunReason:   "IPNotFound",
+		controller.AnnotationDryRunMessage:  "IP 123.123.123.123 is not an address of instance test-deny-virtual-name",
+	}).
+		Return(nilError)
+
+	cfg := testConfig(testRegexp)
+	cfg.DryRun = true
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequestApprove
+	certificateSigningRequestsChan <- testCertificateSigningRequestDeny
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+}
+
+func TestDryRunRecorded(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	// The request comes back after the annotation patch with the decision already recorded.
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+	testCertificateSigningRequest.Annotations = map[string]string{
+		controller.AnnotationDryRunDecision: "approve",
+		controller.AnnotationDryRunReason:   "InstanceVerified",
+		controller.AnnotationDryRunMessage:  "IP and DNS SANs belong to instance test-virtual-name",
+	}
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(&controller.Instance{Addresses: testIPSet}, nilError)
+
+	testPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditSink, err := controller.NewFileAuditSink(testPath)
+	require.NoError(t, err)
+
+	cfg := testConfig(testRegexp)
+	cfg.DryRun = true
+	cfg.AuditSink = auditSink
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+
+	content, err := os.ReadFile(testPath)
+	require.NoError(t, err)
+	require.Empty(t, content)
+}
+
+func TestAudit(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testVirtualMachineName := "test-virtual-name"
+	testCommonName := fmt.Sprintf("system:node:%s", testVirtualMachineName)
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+	testCertificateSigningRequest := testCSR(t, testCommonName, testIPSet)
+	testCertificateSigningRequest.UID = "test-uid"
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Approve", testCertificateSigningRequest, mock.Anything).
+		Return(nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
+
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineName).
+		Return(&controller.Instance{ID: "test-instance-id", Addresses: testIPSet}, nilError)
+
+	testPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditSink, err := controller.NewFileAuditSink(testPath)
+	require.NoError(t, err)
+
+	cfg := testConfig(testRegexp)
+	cfg.AuditSink = auditSink
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequest
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+
+	content, err := os.ReadFile(testPath)
+	require.NoError(t, err)
+
+	var record controller.AuditRecord
+	require.NoError(t, json.Unmarshal(content, &record))
+
+	require.Equal(t, testCertificateSigningRequest.Name, record.Name)
+	require.Equal(t, "test-uid", record.UID)
+	require.Equal(t, v1.KubeletServingSignerName, record.Signer)
+	require.Equal(t, testCommonName, record.Username)
+	require.Equal(t, []string{"123.123.123.123"}, record.IPAddresses)
+	require.Equal(t, "test-instance-id", record.InstanceID)
+	require.Equal(t, []string{"123.123.123.123"}, record.InstanceAddresses)
+	require.Contains(t, record.Rules, controller.RuleResult{Name: "requester", Passed: true})
+	require.Contains(t, record.Rules, controller.RuleResult{Name: "ip_san_123.123.123.123", Passed: true})
+	require.Equal(t, "approve", record.Decision)
+	require.Equal(t, "InstanceVerified", record.Reason)
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	testVirtualMachineFirstName := "test-first-virtual-name"
+	testCertificateSigningRequestFirst := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineFirstName), testIPSet)
+
+	testVirtualMachineSecondName := "test-second-virtual-name"
+	testCertificateSigningRequestSecond := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineSecondName), testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Stop").
+		Run(func(mock.Arguments) {
+			close(certificateSigningRequestsChan)
+		})
+	k8sMock.On("Approve", testCertificateSigningRequestFirst, mock.Anything).
+		Return(nilError)
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError)
+	k8sMock.On("Approve", testCertificateSigningRequestSecond, mock.Anything).
+		Return(nilError)
+
+	// The first lookup is released only by the second one, so both requests must be processed in parallel.
+	secondStarted := make(chan struct{})
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineFirstName).
+		Return(&controller.Instance{Addresses: testIPSet}, nilError).
+		Run(func(mock.Arguments) {
+			<-secondStarted
+		})
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineSecondName).
+		Return(&controller.Instance{Addresses: testIPSet}, nilError).
+		Run(func(mock.Arguments) {
+			close(secondStarted)
+		})
+
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		testConfig(testRegexp),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequestFirst
+	certificateSigningRequestsChan <- testCertificateSigningRequestSecond
+
+	ctrl.Stop()
+}
+
+func TestAbortDropsQueue(t *testing.T) {
+	testRegexp := "system:node:(.[^ ]*)"
+	testIPSet := []net.IP{
+		net.ParseIP("123.123.123.123"),
+	}
+
+	testVirtualMachineFirstName := "test-first-virtual-name"
+	testCertificateSigningRequestFirst := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineFirstName), testIPSet)
+
+	testVirtualMachineSecondName := "test-second-virtual-name"
+	testCertificateSigningRequestSecond := testCSR(t, fmt.Sprintf("system:node:%s", testVirtualMachineSecondName), testIPSet)
+
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	firstStarted := make(chan struct{})
+	release := make(chan struct{})
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+	k8sMock.On("Stop").
+		Run(func(mock.Arguments) {
+			close(certificateSigningRequestsChan)
+			close(release)
+		})
+	// The request in flight may finish, its calls fail on the cancelled context outside of the mocks.
+	k8sMock.On("GetNode", mock.Anything).
+		Return(nil, nilError).
+		Maybe()
+	k8sMock.On("Approve", testCertificateSigningRequestFirst, mock.Anything).
+		Return(nilError).
+		Maybe()
+
+	// The second request is never looked up: the only worker is busy until the abort.
+	cloudMock := mocks.NewCloud(t)
+	cloudMock.On("GetInstance", controller.LookupName, testVirtualMachineFirstName).
+		Return(&controller.Instance{Addresses: testIPSet}, nilError).
+		Run(func(mock.Arguments) {
+			close(firstStarted)
+			<-release
+		})
+
+	cfg := testConfig(testRegexp)
+	cfg.Workers = 1
+	ctrl, err := controller.New(
+		k8sMock,
+		cloudMock,
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Start())
+	certificateSigningRequestsChan <- testCertificateSigningRequestFirst
+	<-firstStarted
+	certificateSigningRequestsChan <- testCertificateSigningRequestSecond
+
+	ctrl.Abort()
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	k8sMock := mocks.NewK8s(t)
+	k8sMock.On("Stop")
+
+	ctrl, err := controller.New(
+		k8sMock,
+		mocks.NewCloud(t),
+		testConfig("system:node:(.[^ ]*)"),
+	)
+	require.NoError(t, err)
+
+	// A Start that comes after Stop, e.g. when leadership is acquired during shutdown, must not subscribe.
+	ctrl.Stop()
+	require.NoError(t, ctrl.Start())
+	<-ctrl.Done()
+}
+
+func TestHealthReports(t *testing.T) {
+	k8sMock := mocks.NewK8s(t)
+	certificateSigningRequestsChan := make(chan controller.Event)
+	var certificateSigningRequestsOutChan <-chan controller.Event = certificateSigningRequestsChan
+
+	k8sMock.On("CertificateSigningRequestsChan").
+		Return(certificateSigningRequestsOutChan, nilError)
+
+	checker := health.New()
+	cfg := testConfig("system:node:(.[^ ]*)")
+	cfg.Health = checker
+	ctrl, err := controller.New(
+		k8sMock,
+		mocks.NewCloud(t),
+		cfg,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, checker.Ready(time.Minute), "standby controller must be ready")
+	require.NoError(t, ctrl.Start())
+	require.Eventually(t, func() bool {
+		return checker.Ready(time.Minute) != nil
+	}, 5*time.Second, time.Millisecond, "running controller must report to its checker")
+
+	close(certificateSigningRequestsChan)
+	<-ctrl.Done()
+	require.NoError(t, checker.Ready(time.Minute))
+}
+
+func testConfig(instanceNameLayout string) controller.Config {
+	return controller.Config{
+		InstanceNameLayout: instanceNameLayout,
+		Signers:            testSigners,
+		NodeGroups:         []string{"system:nodes"},
+		BootstrapGroups:    []string{"system:bootstrappers"},
+		KeyAlgorithms:      []string{controller.KeyAlgorithmRSA, controller.KeyAlgorithmECDSA},
+		MinRSAKeySize:      2048,
+		MinECDSAKeySize:    256,
+		Workers:            2,
+		RetryBaseDelay:     time.Millisecond,
+		RetryMaxDelay:      time.Second,
+	}
+}
+
+func testCSR(t *testing.T, testCommonName string, testIPSet []net.IP) *v1.CertificateSigningRequest {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   testCommonName,
+			Organization: []string{"system:nodes"},
+		},
+		IPAddresses: testIPSet,
+	}
+
+	return testCSRFromTemplate(t, template, pk)
+}
+
+func testClientCSR(t *testing.T, testVirtualMachineName string, dnsNames []string) *v1.CertificateSigningRequest {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   fmt.Sprintf("system:node:%s", testVirtualMachineName),
+			Organization: []string{"system:nodes"},
+		},
+		DNSNames: dnsNames,
+	}
+
+	r := testCSRFromTemplate(t, template, pk)
+	r.Spec.SignerName = v1.KubeAPIServerClientKubeletSignerName
+	r.Spec.Usages = []v1.KeyUsage{
+		v1.UsageDigitalSignature,
+		v1.UsageKeyEncipherment,
+		v1.UsageClientAuth,
+	}
+	return r
+}
+
+func testCSRFromTemplate(t *testing.T, template x509.CertificateRequest, pk any) *v1.CertificateSigningRequest {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, pk)
+	require.NoError(t, err)
+
+	return &v1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("csr-%s", uuid.New().String()),
+		},
+		Spec: v1.CertificateSigningRequestSpec{
+			SignerName: v1.KubeletServingSignerName,
+			Username:   template.Subject.CommonName,
+			Groups:     []string{"system:nodes", "system:authenticated"},
+			Usages: []v1.KeyUsage{
+				v1.UsageDigitalSignature,
+				v1.UsageKeyEncipherment,
+				v1.UsageServerAuth,
+			},
+			Request: pem.EncodeToMemory(
+				&pem.Block{
+					Type:  "CERTIFICATE REQUEST",
+					Bytes: csr,
+				},
+			),
+		},
+	}
+}
+
+func testNode(name, providerID string, addresses ...corev1.NodeAddress) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.NodeSpec{
+			ProviderID: providerID,
+		},
+		Status: corev1.NodeStatus{
+			Addresses: addresses,
 		},
 	}
 }
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/certificates/v1"
+)
+
+type verdict string
+
+const (
+	verdictApprove verdict = "approve"
+	verdictDeny    verdict = "deny"
+	// verdictAbstain leaves the request pending, it is retried later.
+	verdictAbstain verdict = "abstain"
+)
+
+// Annotations written on requests in dry-run mode.
+const (
+	AnnotationDryRunDecision = "cluster-machine-approver.fraima.io/dry-run-decision"
+	AnnotationDryRunReason   = "cluster-machine-approver.fraima.io/dry-run-reason"
+	AnnotationDryRunMessage  = "cluster-machine-approver.fraima.io/dry-run-message"
+)
+
+// Reasons follow the CamelCase convention of condition and event reasons.
+const (
+	reasonVerified            = "InstanceVerified"
+	reasonInvalidRequest      = "InvalidRequest"
+	reasonInstanceNameMissing = "InstanceNameNotFound"
+	reasonRequesterMismatch   = "RequesterMismatch"
+	reasonCloudError          = "CloudError"
+	reasonAmbiguousInstance   = "AmbiguousInstance"
+	reasonInstanceState       = "InstanceStateNotAllowed"
+	reasonInstanceNotSelected = "InstanceNotSelected"
+	reasonInstanceGroup       = "InstanceGroupNotAllowed"
+	// reasonInstanceGroupsUnknown abstains when groups are required but the cloud does not resolve them.
+	reasonInstanceGroupsUnknown = "InstanceGroupsUnknown"
+	reasonInstanceTooOld        = "InstanceTooOld"
+	reasonIPNotFound            = "IPNotFound"
+	reasonDNSNameNotFound       = "DNSNameNotFound"
+	reasonPolicyViolation       = "PolicyViolation"
+	reasonNodeError             = "NodeLookupFailed"
+	reasonProviderIDMismatch    = "ProviderIDMismatch"
+	reasonNodeAddressMismatch   = "NodeAddressMismatch"
+)
+
+// Explanation is written into the approval condition and the events of a decision.
+type Explanation struct {
+	// NodeName is the node the request is for, events are also emitted on it if it exists.
+	NodeName string
+	Reason   string
+	Message  string
+}
+
+type decision struct {
+	verdict verdict
+	// reason is a short stable cause used in conditions, events, logs and metrics.
+	reason string
+	// message explains the decision to whoever inspects the request.
+	message  string
+	nodeName string
+	err      error
+
+	evaluation *evaluation
+}
+
+func (d decision) explanation() Explanation {
+	return Explanation{
+		NodeName: d.nodeName,
+		Reason:   d.reason,
+		Message:  d.message,
+	}
+}
+
+// denial is the cause of a failed check, checks return nil when they pass.
+type denial struct {
+	reason  string
+	message string
+}
+
+func denied(reason, format string, args ...any) *denial {
+	return &denial{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+func (d *denial) decision() decision {
+	return deny(d.reason, d.message)
+}
+
+func approve(message string) decision {
+	return decision{verdict: verdictApprove, reason: reasonVerified, message: message}
+}
+
+func deny(reason, message string) decision {
+	return decision{verdict: verdictDeny, reason: reason, message: message}
+}
+
+func abstain(reason string, err error) decision {
+	return decision{verdict: verdictAbstain, reason: reason, err: err}
+}
+
+// dryRunRecorded reports whether the dry-run annotations of the request already hold the decision.
+func dryRunRecorded(r *v1.CertificateSigningRequest, d decision) bool {
+	return r.Annotations[AnnotationDryRunDecision] == string(d.verdict) && r.Annotations[AnnotationDryRunReason] == d.reason
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/certificates/v1"
+)
+
+const nodeUserPrefix = "system:node:"
+
+// checkRequester verifies that the identity which created the request may ask for commonName.
+// Members of node groups may only request certificates for their own name,
+// members of bootstrap groups may only request kubelet client certificates verified by the client policy,
+// which passes allowBootstrap.
+func (s *controller) checkRequester(req *v1.CertificateSigningRequest, commonName string, allowBootstrap bool) error {
+	if hasAnyGroup(req.Spec.Groups, s.nodeGroups) {
+		if req.Spec.Username != commonName {
+			return fmt.Errorf("requester %q may not request a certificate for %q", req.Spec.Username, commonName)
+		}
+		return nil
+	}
+
+	if allowBootstrap && req.Spec.SignerName == v1.KubeAPIServerClientKubeletSignerName && hasAnyGroup(req.Spec.Groups, s.bootstrapGroups) {
+		return nil
+	}
+
+	return fmt.Errorf("requester %q in groups %v is not allowed to request %q certificates", req.Spec.Username, req.Spec.Groups, req.Spec.SignerName)
+}
+
+func hasAnyGroup(groups, allowed []string) bool {
+	for _, g := range groups {
+		for _, a := range allowed {
+			if g == a {
+				return true
+			}
+		}
+	}
+	return false
+}
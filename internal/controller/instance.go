@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"crypto/x509"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// checkInstance verifies that the instance is in an allowed state, is selected by the instance selector
+// and belongs to an allowed group.
+func (s *controller) checkInstance(virtualMachineName string, instance *Instance, ev *evaluation) *denial {
+	if len(s.instanceStates) > 0 && !ev.check("instance_state", stateIsAllowed(instance.Status, s.instanceStates)) {
+		return denied(reasonInstanceState, "instance %s is %s, allowed states are %v", virtualMachineName, instance.Status, s.instanceStates)
+	}
+
+	if !s.instanceSelector.Empty() && !ev.check("instance_selector", s.instanceSelector.Matches(labels.Set(instance.Labels))) {
+		return denied(reasonInstanceNotSelected, "instance %s labels %v do not match selector %s", virtualMachineName, instance.Labels, s.instanceSelector)
+	}
+
+	if len(s.instanceGroups) > 0 && !ev.check("instance_group", hasAnyGroup(instance.Groups, s.instanceGroups)) {
+		return denied(reasonInstanceGroup, "instance %s is in groups %v, none of them is allowed", virtualMachineName, instance.Groups)
+	}
+	return nil
+}
+
+// checkSANs verifies that the IP SANs are addresses and the DNS SANs are hostnames of the instance.
+func (s *controller) checkSANs(virtualMachineName string, instance *Instance, csr *x509.CertificateRequest, ev *evaluation) *denial {
+	for _, ip := range csr.IPAddresses {
+		if !ev.check("ip_san_"+ip.String(), ipIsExist(ip, instance.Addresses)) {
+			return denied(reasonIPNotFound, "IP %s is not an address of instance %s", ip, virtualMachineName)
+		}
+	}
+
+	for _, name := range csr.DNSNames {
+		if !ev.check("dns_san_"+name, dnsNameIsExist(name, instance.Hostnames, s.dnsSuffixes)) {
+			return denied(reasonDNSNameNotFound, "DNS name %s is not a hostname of instance %s", name, virtualMachineName)
+		}
+	}
+	return nil
+}
+
+// checkInstanceAge verifies that the instance was created no longer than the maximum bootstrap age ago.
+func (s *controller) checkInstanceAge(virtualMachineName string, instance *Instance, ev *evaluation) *denial {
+	if !ev.check("instance_age", !instance.CreatedAt.IsZero() && time.Since(instance.CreatedAt) <= s.maxInstanceAge) {
+		if instance.CreatedAt.IsZero() {
+			return denied(reasonInstanceTooOld, "creation time of instance %s is unknown", virtualMachineName)
+		}
+		return denied(reasonInstanceTooOld, "instance %s was created at %s, bootstrap is allowed for %s after creation",
+			virtualMachineName, instance.CreatedAt.Format(time.RFC3339), s.maxInstanceAge)
+	}
+	return nil
+}
+
+func stateIsAllowed(state string, allowed []string) bool {
+	for _, a := range allowed {
+		if state == a {
+			return true
+		}
+	}
+	return false
+}
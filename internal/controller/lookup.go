@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+)
+
+// Lookup is the attribute a cloud instance is looked up by.
+type Lookup string
+
+const (
+	// LookupName looks the instance up by the name captured from the CommonName.
+	LookupName Lookup = "name"
+	// LookupID looks the instance up by the instance ID captured from the CommonName.
+	LookupID Lookup = "id"
+	// LookupFQDN looks the instance up by the FQDN captured from the CommonName.
+	LookupFQDN Lookup = "fqdn"
+	// LookupProviderID looks the instance up by the instance ID in the providerID of the registered node.
+	// Clouds never receive it, they are asked for LookupID instead.
+	LookupProviderID Lookup = "providerID"
+)
+
+func parseLookup(lookup Lookup) (Lookup, error) {
+	switch lookup {
+	case "":
+		return LookupName, nil
+	case LookupName, LookupID, LookupFQDN, LookupProviderID:
+		return lookup, nil
+	}
+	return "", fmt.Errorf("unknown instance lookup %q", lookup)
+}
+
+type freshDataKey struct{}
+
+// WithFreshData marks a lookup that must not be answered from cached data.
+// The controller uses it to confirm an instance before denying a request because of it.
+func WithFreshData(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshDataKey{}, true)
+}
+
+// FreshData reports whether the lookup must bypass caches and indexes.
+func FreshData(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshDataKey{}).(bool)
+	return fresh
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getNode returns the registered node or nil.
+func (s *controller) getNode(nodeName string) (*corev1.Node, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+
+	return s.k8s.GetNode(ctx, nodeName)
+}
+
+// checkNode verifies that a registered node is the same machine as the instance:
+// its providerID must point to the instance and the SANs must be among its status addresses.
+func checkNode(node *corev1.Node, instance *Instance, csr *x509.CertificateRequest, ev *evaluation) *denial {
+	if _, d := checkProviderID(node, instance, ev); d != nil {
+		return d
+	}
+
+	if len(node.Status.Addresses) == 0 {
+		return nil
+	}
+
+	ips, hostnames := nodeAddresses(node)
+	for _, ip := range csr.IPAddresses {
+		if !ev.check("node_ip_san_"+ip.String(), ipIsExist(ip, ips)) {
+			return denied(reasonNodeAddressMismatch, "IP %s is not an address of node %s", ip, node.Name)
+		}
+	}
+	for _, name := range csr.DNSNames {
+		if !ev.check("node_dns_san_"+name, dnsNameIsExist(name, hostnames, nil)) {
+			return denied(reasonNodeAddressMismatch, "DNS name %s is not an address of node %s", name, node.Name)
+		}
+	}
+	return nil
+}
+
+// checkNodeInstance verifies that a registered node was registered by the instance:
+// its providerID must point to the instance or, until the providerID is set, one of its IPs must belong to the instance.
+func checkNodeInstance(node *corev1.Node, instance *Instance, ev *evaluation) *denial {
+	if checked, d := checkProviderID(node, instance, ev); checked {
+		return d
+	}
+
+	ips, _ := nodeAddresses(node)
+	if len(ips) == 0 {
+		return nil
+	}
+	for _, ip := range ips {
+		if ipIsExist(ip, instance.Addresses) {
+			ev.check("node_addresses", true)
+			return nil
+		}
+	}
+	ev.check("node_addresses", false)
+	return denied(reasonNodeAddressMismatch, "node %s is registered with addresses %v, none of them belongs to the instance", node.Name, ips)
+}
+
+// checkProviderID compares the providerID of the node with the instance if both are known and reports whether it did.
+func checkProviderID(node *corev1.Node, instance *Instance, ev *evaluation) (bool, *denial) {
+	if node.Spec.ProviderID == "" || instance.ID == "" {
+		return false, nil
+	}
+	if !ev.check("node_provider_id", providerInstanceID(node.Spec.ProviderID) == instance.ID) {
+		return true, denied(reasonProviderIDMismatch, "node %s has providerID %s, but the instance is %s", node.Name, node.Spec.ProviderID, instance.ID)
+	}
+	return true, nil
+}
+
+// nodeAddresses returns the IPs and the DNS names in the status of the node.
+func nodeAddresses(node *corev1.Node) ([]net.IP, []string) {
+	var ips []net.IP
+	var hostnames []string
+	for _, a := range node.Status.Addresses {
+		switch a.Type {
+		case corev1.NodeInternalIP, corev1.NodeExternalIP:
+			if ip := net.ParseIP(a.Address); ip != nil {
+				ips = append(ips, ip)
+			}
+		case corev1.NodeHostName, corev1.NodeInternalDNS, corev1.NodeExternalDNS:
+			hostnames = append(hostnames, a.Address)
+		}
+	}
+	return ips, hostnames
+}
+
+// providerInstanceID is the last segment of a providerID such as yandex://<instance id>.
+func providerInstanceID(providerID string) string {
+	return providerID[strings.LastIndex(providerID, "/")+1:]
+}
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/certificates/v1"
+)
+
+const (
+	KeyAlgorithmRSA     = "RSA"
+	KeyAlgorithmECDSA   = "ECDSA"
+	KeyAlgorithmEd25519 = "Ed25519"
+)
+
+type rule struct {
+	name  string
+	check func(req *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool
+}
+
+// servingRules returns the upstream kubelet-serving content rules.
+func servingRules(keyAlgorithms []string, minRSAKeySize, minECDSAKeySize int) ([]rule, error) {
+	keys, err := keyRules(keyAlgorithms, minRSAKeySize, minECDSAKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]rule{
+		{
+			name: "required_usages",
+			check: func(req *v1.CertificateSigningRequest, _ *x509.CertificateRequest) bool {
+				return hasUsage(req.Spec.Usages, v1.UsageDigitalSignature) && hasUsage(req.Spec.Usages, v1.UsageServerAuth)
+			},
+		},
+		{
+			name: "allowed_usages",
+			check: func(req *v1.CertificateSigningRequest, _ *x509.CertificateRequest) bool {
+				for _, u := range req.Spec.Usages {
+					switch u {
+					case v1.UsageDigitalSignature, v1.UsageKeyEncipherment, v1.UsageServerAuth:
+					default:
+						return false
+					}
+				}
+				return true
+			},
+		},
+		{
+			name: "organization",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.Subject.Organization) == 1 && csr.Subject.Organization[0] == "system:nodes"
+			},
+		},
+		{
+			name: "common_name",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return strings.HasPrefix(csr.Subject.CommonName, nodeUserPrefix) && len(csr.Subject.CommonName) > len(nodeUserPrefix)
+			},
+		},
+		{
+			name: "no_email_sans",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.EmailAddresses) == 0
+			},
+		},
+		{
+			name: "no_uri_sans",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.URIs) == 0
+			},
+		},
+		{
+			name: "dns_or_ip_san",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0
+			},
+		},
+	}, keys...), nil
+}
+
+// clientRules returns the upstream kube-apiserver-client-kubelet content rules.
+func clientRules(keyAlgorithms []string, minRSAKeySize, minECDSAKeySize int) ([]rule, error) {
+	keys, err := keyRules(keyAlgorithms, minRSAKeySize, minECDSAKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]rule{
+		{
+			name: "required_usages",
+			check: func(req *v1.CertificateSigningRequest, _ *x509.CertificateRequest) bool {
+				return hasUsage(req.Spec.Usages, v1.UsageDigitalSignature) && hasUsage(req.Spec.Usages, v1.UsageClientAuth)
+			},
+		},
+		{
+			name: "allowed_usages",
+			check: func(req *v1.CertificateSigningRequest, _ *x509.CertificateRequest) bool {
+				for _, u := range req.Spec.Usages {
+					switch u {
+					case v1.UsageDigitalSignature, v1.UsageKeyEncipherment, v1.UsageClientAuth:
+					default:
+						return false
+					}
+				}
+				return true
+			},
+		},
+		{
+			name: "organization",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.Subject.Organization) == 1 && csr.Subject.Organization[0] == "system:nodes"
+			},
+		},
+		{
+			name: "common_name",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return strings.HasPrefix(csr.Subject.CommonName, nodeUserPrefix) && len(csr.Subject.CommonName) > len(nodeUserPrefix)
+			},
+		},
+		{
+			name: "no_sans",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				return len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 && len(csr.EmailAddresses) == 0 && len(csr.URIs) == 0
+			},
+		},
+	}, keys...), nil
+}
+
+// keyRules returns the rules on the public key shared by every signer.
+func keyRules(keyAlgorithms []string, minRSAKeySize, minECDSAKeySize int) ([]rule, error) {
+	for _, a := range keyAlgorithms {
+		switch a {
+		case KeyAlgorithmRSA, KeyAlgorithmECDSA, KeyAlgorithmEd25519:
+		default:
+			return nil, fmt.Errorf("unknown key algorithm %q", a)
+		}
+	}
+
+	return []rule{
+		{
+			name: "key_algorithm",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				name := keyAlgorithmName(csr.PublicKeyAlgorithm)
+				for _, a := range keyAlgorithms {
+					if a == name {
+						return true
+					}
+				}
+				return false
+			},
+		},
+		{
+			name: "key_size",
+			check: func(_ *v1.CertificateSigningRequest, csr *x509.CertificateRequest) bool {
+				switch key := csr.PublicKey.(type) {
+				case *rsa.PublicKey:
+					return key.N.BitLen() >= minRSAKeySize
+				case *ecdsa.PublicKey:
+					return key.Curve.Params().BitSize >= minECDSAKeySize
+				case ed25519.PublicKey:
+					return true
+				}
+				return false
+			},
+		},
+	}, nil
+}
+
+// violations records every rule in ev and returns the names of the rules the request does not satisfy.
+func violations(rules []rule, req *v1.CertificateSigningRequest, csr *x509.CertificateRequest, ev *evaluation) []string {
+	var violated []string
+	for _, r := range rules {
+		if !ev.check(r.name, r.check(req, csr)) {
+			violated = append(violated, r.name)
+		}
+	}
+	return violated
+}
+
+func hasUsage(usages []v1.KeyUsage, usage v1.KeyUsage) bool {
+	for _, u := range usages {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func keyAlgorithmName(a x509.PublicKeyAlgorithm) string {
+	switch a {
+	case x509.RSA:
+		return KeyAlgorithmRSA
+	case x509.ECDSA:
+		return KeyAlgorithmECDSA
+	case x509.Ed25519:
+		return KeyAlgorithmEd25519
+	}
+	return a.String()
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/certificates/v1"
+)
+
+const (
+	// PolicyServing checks that every IP SAN of the request belongs to the cloud instance named in its CommonName.
+	PolicyServing = "serving"
+	// PolicyClient checks that the cloud instance named in the CommonName exists and may join the cluster as that node.
+	PolicyClient = "client"
+)
+
+type policy func(s *controller, req *v1.CertificateSigningRequest, logger *zap.Logger) decision
+
+var policies = map[string]policy{
+	PolicyServing: verificationWith((*controller).verifyServing),
+	PolicyClient:  verificationWith((*controller).verifyClient),
+}
+
+func verificationWith(verify verifier) policy {
+	return func(s *controller, req *v1.CertificateSigningRequest, logger *zap.Logger) decision {
+		return s.verification(req, logger, verify)
+	}
+}
+
+// newSignerRegistry resolves the signer name to policy name mapping from the configuration.
+func newSignerRegistry(signers map[string]string) (map[string]policy, error) {
+	registry := make(map[string]policy, len(signers))
+	for signerName, policyName := range signers {
+		p, ok := policies[policyName]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q for signer %q", policyName, signerName)
+		}
+		registry[signerName] = p
+	}
+	return registry, nil
+}
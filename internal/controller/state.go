@@ -0,0 +1,36 @@
+package controller
+
+import (
+	v1 "k8s.io/api/certificates/v1"
+)
+
+type requestState string
+
+const (
+	statePending  requestState = "pending"
+	stateApproved requestState = "approved"
+	stateDenied   requestState = "denied"
+	stateFailed   requestState = "failed"
+	stateIssued   requestState = "issued"
+)
+
+// getRequestState derives the lifecycle state of a request from its status.
+// An issued certificate wins over conditions, and a terminal Denied or Failed condition wins over Approved.
+func getRequestState(r *v1.CertificateSigningRequest) requestState {
+	if len(r.Status.Certificate) > 0 {
+		return stateIssued
+	}
+
+	state := statePending
+	for _, c := range r.Status.Conditions {
+		switch c.Type {
+		case v1.CertificateDenied:
+			return stateDenied
+		case v1.CertificateFailed:
+			return stateFailed
+		case v1.CertificateApproved:
+			state = stateApproved
+		}
+	}
+	return state
+}
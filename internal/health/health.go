@@ -0,0 +1,169 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Checker tracks the state reported by the liveness and readiness probes.
+type Checker struct {
+	mu sync.Mutex
+
+	// active is set while this replica runs the controller, standby replicas are always ready.
+	active           bool
+	watchEstablished bool
+	lastCloudSuccess time.Time
+	lastCloudError   error
+
+	nextID     uint64
+	processing map[uint64]time.Time
+
+	// lastIntake is the last heartbeat of the request intake loop, queued is the queue length it reported
+	// and queuedSince the time the queue stopped being empty. lastWorker is the last time a worker took a request.
+	lastIntake  time.Time
+	queued      int
+	queuedSince time.Time
+	lastWorker  time.Time
+
+	now func() time.Time
+}
+
+func New() *Checker {
+	return &Checker{
+		processing: make(map[uint64]time.Time),
+		now:        time.Now,
+	}
+}
+
+func (c *Checker) SetActive(active bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = active
+	c.lastIntake = c.now()
+	c.queued = 0
+}
+
+func (c *Checker) SetWatchEstablished(established bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchEstablished = established
+}
+
+// ObserveCloudCall records the result of a cloud call, errors caused by the request itself must not be passed.
+func (c *Checker) ObserveCloudCall(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastCloudError = err
+	if err == nil {
+		c.lastCloudSuccess = c.now()
+	}
+}
+
+// IntakeHeartbeat is reported periodically by the request intake loop with the number of queued requests.
+func (c *Checker) IntakeHeartbeat(queued int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.lastIntake = now
+	if queued > 0 && c.queued == 0 {
+		c.queuedSince = now
+	}
+	c.queued = queued
+}
+
+// WorkerHeartbeat is reported by a worker every time it takes a request from the queue.
+func (c *Checker) WorkerHeartbeat() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastWorker = c.now()
+}
+
+// StartProcessing marks the start of processing one request, the returned func marks its end.
+func (c *Checker) StartProcessing() func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID
+	c.nextID++
+	c.processing[id] = c.now()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.processing, id)
+	}
+}
+
+// Live fails when a request has been processed for longer than processingTimeout or, while the controller runs,
+// when the intake loop has not reported for processingTimeout or requests have been queued for that long
+// without any worker taking one.
+func (c *Checker) Live(processingTimeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, started := range c.processing {
+		if d := now.Sub(started); d > processingTimeout {
+			return fmt.Errorf("a request is processed for %s", d.Round(time.Second))
+		}
+	}
+
+	if !c.active {
+		return nil
+	}
+	if d := now.Sub(c.lastIntake); d > processingTimeout {
+		return fmt.Errorf("request intake has not reported for %s", d.Round(time.Second))
+	}
+	if c.queued > 0 {
+		idle := c.queuedSince
+		if c.lastWorker.After(idle) {
+			idle = c.lastWorker
+		}
+		if d := now.Sub(idle); d > processingTimeout {
+			return fmt.Errorf("%d requests are queued, no worker has taken one for %s", c.queued, d.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// Ready fails when the CSR watch is down or cloud calls have been failing for longer than cloudWindow.
+func (c *Checker) Ready(cloudWindow time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return nil
+	}
+	if !c.watchEstablished {
+		return errors.New("csr watch is not established")
+	}
+	if c.lastCloudError != nil && c.now().Sub(c.lastCloudSuccess) > cloudWindow {
+		return fmt.Errorf("cloud calls are failing: %w", c.lastCloudError)
+	}
+	return nil
+}
+
+// Register serves /healthz and /readyz from the checker.
+func Register(mux *http.ServeMux, c *Checker, processingTimeout, cloudWindow time.Duration) {
+	mux.HandleFunc("/healthz", handler(func() error {
+		return c.Live(processingTimeout)
+	}))
+	mux.HandleFunc("/readyz", handler(func() error {
+		return c.Ready(cloudWindow)
+	}))
+}
+
+func handler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}
+}
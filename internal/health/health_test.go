@@ -0,0 +1,84 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLive(t *testing.T) {
+	now := time.Now()
+	c := New()
+	c.now = func() time.Time { return now }
+
+	done := c.StartProcessing()
+	require.NoError(t, c.Live(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	require.Error(t, c.Live(time.Minute))
+
+	done()
+	require.NoError(t, c.Live(time.Minute))
+}
+
+func TestLiveHeartbeats(t *testing.T) {
+	now := time.Now()
+	c := New()
+	c.now = func() time.Time { return now }
+
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, c.Live(time.Minute), "standby replica has no intake loop")
+
+	c.SetActive(true)
+	c.WorkerHeartbeat()
+	c.IntakeHeartbeat(3)
+	require.NoError(t, c.Live(time.Minute))
+
+	now = now.Add(30 * time.Second)
+	c.IntakeHeartbeat(3)
+	require.NoError(t, c.Live(time.Minute), "requests are queued for less than the timeout")
+
+	now = now.Add(time.Minute)
+	c.IntakeHeartbeat(3)
+	require.Error(t, c.Live(time.Minute), "no worker takes queued requests")
+
+	c.WorkerHeartbeat()
+	require.NoError(t, c.Live(time.Minute))
+
+	c.IntakeHeartbeat(0)
+	now = now.Add(2 * time.Minute)
+	require.Error(t, c.Live(time.Minute), "intake loop does not report")
+
+	c.IntakeHeartbeat(1)
+	require.NoError(t, c.Live(time.Minute), "a worker idle on an empty queue is not stuck")
+}
+
+func TestReady(t *testing.T) {
+	now := time.Now()
+	c := New()
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.Ready(time.Minute), "standby replica must be ready")
+
+	c.SetActive(true)
+	require.Error(t, c.Ready(time.Minute))
+
+	c.SetWatchEstablished(true)
+	require.NoError(t, c.Ready(time.Minute))
+
+	c.ObserveCloudCall(nil)
+	now = now.Add(30 * time.Second)
+	c.ObserveCloudCall(errors.New("cloud is unavailable"))
+	require.NoError(t, c.Ready(time.Minute), "failures within the window are tolerated")
+
+	now = now.Add(time.Minute)
+	require.Error(t, c.Ready(time.Minute))
+
+	c.ObserveCloudCall(nil)
+	require.NoError(t, c.Ready(time.Minute))
+
+	c.SetWatchEstablished(false)
+	require.Error(t, c.Ready(time.Minute))
+}
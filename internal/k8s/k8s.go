@@ -2,110 +2,294 @@ package k8s
 
 import (
 	"context"
-	"os"
+	"encoding/json"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fraima/cluster-machine-approver/internal/controller"
+	"github.com/fraima/cluster-machine-approver/internal/health"
+	"github.com/fraima/cluster-machine-approver/internal/metrics"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	certificatesv1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	v1 "k8s.io/client-go/kubernetes/typed/certificates/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
+const component = "cluster-machine-approver"
+
+type Config struct {
+	// Kubeconfig is used for runs outside of the cluster and takes precedence over the other options.
+	Kubeconfig string
+	// Host is the API server address, the in-cluster configuration is used when it is empty.
+	Host string
+	// TokenFile is reread periodically, so rotated service account tokens are picked up.
+	TokenFile string
+	// CAFile overrides the CA bundle used to verify the API server certificate.
+	CAFile string
+	// Insecure disables verification of the API server certificate.
+	Insecure bool
+
+	ResyncPeriod time.Duration
+
+	// Health receives the state of the request watch, nil uses a checker nobody probes.
+	Health *health.Checker
+}
+
 type k8s struct {
-	csr v1.CertificateSigningRequestInterface
+	client       kubernetes.Interface
+	csr          v1.CertificateSigningRequestInterface
+	recorder     record.EventRecorder
+	resyncPeriod time.Duration
+	health       *health.Checker
 
 	watchers sync.Map
 }
 
-func Connect(kubeHost, kubeTokenFile string) (*k8s, error) {
-	token, err := os.ReadFile(kubeTokenFile)
+func Connect(cfg Config) (*k8s, error) {
+	config, err := restConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	config := &rest.Config{
-		Host:            kubeHost,
-		APIPath:         "/",
-		BearerToken:     string(token),
-		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
-	}
-
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
 	k := &k8s{
-		csr: client.CertificatesV1().CertificateSigningRequests(),
+		client:       client,
+		csr:          client.CertificatesV1().CertificateSigningRequests(),
+		recorder:     broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component}),
+		resyncPeriod: cfg.ResyncPeriod,
+		health:       cfg.Health,
+	}
+	if k.health == nil {
+		k.health = health.New()
 	}
 
 	return k, err
 }
 
+func restConfig(cfg Config) (*rest.Config, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	switch {
+	case cfg.Kubeconfig != "":
+		config, err = clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+	case cfg.Host == "":
+		config, err = rest.InClusterConfig()
+	default:
+		config = &rest.Config{
+			Host:            cfg.Host,
+			BearerTokenFile: cfg.TokenFile,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CAFile != "" {
+		config.TLSClientConfig.CAFile = cfg.CAFile
+		config.TLSClientConfig.CAData = nil
+	}
+
+	if cfg.Insecure {
+		zap.L().Warn("kube_insecure", zap.String("host", config.Host))
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	return config, nil
+}
+
 func (s *k8s) Stop() {
-	s.watchers.Range(func(_, value any) bool {
+	s.watchers.Range(func(key, value any) bool {
 		watcherStop := value.(func())
 		watcherStop()
+		s.watchers.Delete(key)
 		return true
 	})
 }
 
+// CertificateSigningRequestsChan starts an informer on CertificateSigningRequests.
+// The informer relists and rewatches from the last seen resourceVersion with backoff
+// whenever the API server closes the watch, and redelivers every known request once per resync period.
+// Deleted requests are sent once more with DeletionTimestamp set.
+// The channel is closed only by Stop.
 func (s *k8s) CertificateSigningRequestsChan() (<-chan controller.Event, error) {
-	watcher, err := s.csr.Watch(context.TODO(), metav1.ListOptions{})
+	var watching atomic.Bool
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return s.csr.List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				if watching.Swap(true) {
+					metrics.WatchReconnects.Inc()
+				}
+				w, err := s.csr.Watch(context.TODO(), options)
+				s.health.SetWatchEstablished(err == nil)
+				return w, err
+			},
+		},
+		&certificatesv1.CertificateSigningRequest{},
+		s.resyncPeriod,
+		cache.Indexers{},
+	)
+
+	err := informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		s.health.SetWatchEstablished(false)
+		zap.L().Warn("csr_watch", zap.Error(err))
+	})
 	if err != nil {
 		return nil, err
 	}
+
 	rChan := make(chan controller.Event)
-	s.watchers.Store(uuid.New().String(), stopWatcher(rChan, watcher.Stop))
+	stopCh := make(chan struct{})
 
-	go func() {
-		for event := range watcher.ResultChan() {
-			obj, ok := event.Object.(*certificatesv1.CertificateSigningRequest)
-			if !ok {
-				zap.L().Warn("converting", zap.Any("event", event))
-				continue
-			}
-			rChan <- obj
+	send := func(obj any, deleted bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		r, ok := obj.(*certificatesv1.CertificateSigningRequest)
+		if !ok {
+			zap.L().Warn("converting", zap.Any("object", obj))
+			return
+		}
+		// Objects from the informer cache are shared and must not be mutated.
+		r = r.DeepCopy()
+		if deleted && r.DeletionTimestamp == nil {
+			now := metav1.Now()
+			r.DeletionTimestamp = &now
+		}
+		select {
+		case rChan <- r:
+		case <-stopCh:
 		}
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			send(obj, false)
+		},
+		UpdateFunc: func(_, newObj any) {
+			send(newObj, false)
+		},
+		DeleteFunc: func(obj any) {
+			send(obj, true)
+		},
+	})
+
+	s.watchers.Store(uuid.New().String(), stopWatcher(stopCh))
+
+	go func() {
+		// Run returns only after every event handler has finished, so closing here is safe.
+		informer.Run(stopCh)
+		close(rChan)
 	}()
-	return rChan, err
+	return rChan, nil
 }
 
-func (s *k8s) Approve(ctx context.Context, r *certificatesv1.CertificateSigningRequest) error {
-	r.Status.Conditions = append(r.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
-		Status:         corev1.ConditionTrue,
-		Type:           certificatesv1.CertificateApproved,
-		Reason:         "User activation",
-		Message:        "This CSR was approved",
-		LastUpdateTime: metav1.Now(),
+func (s *k8s) Approve(ctx context.Context, r *certificatesv1.CertificateSigningRequest, e controller.Explanation) error {
+	return s.updateApproval(ctx, r, certificatesv1.CertificateApproved, corev1.EventTypeNormal, e)
+}
+
+func (s *k8s) Deny(ctx context.Context, r *certificatesv1.CertificateSigningRequest, e controller.Explanation) error {
+	return s.updateApproval(ctx, r, certificatesv1.CertificateDenied, corev1.EventTypeWarning, e)
+}
+
+func (s *k8s) Annotate(ctx context.Context, r *certificatesv1.CertificateSigningRequest, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": annotations,
+		},
 	})
+	if err != nil {
+		return err
+	}
 
-	_, err := s.csr.UpdateApproval(ctx, r.Name, r, metav1.UpdateOptions{})
+	_, err = s.csr.Patch(ctx, r.Name, types.MergePatchType, patch, metav1.PatchOptions{})
 	return err
 }
 
-func (s *k8s) Deny(ctx context.Context, r *certificatesv1.CertificateSigningRequest) error {
+func (s *k8s) updateApproval(
+	ctx context.Context,
+	r *certificatesv1.CertificateSigningRequest,
+	conditionType certificatesv1.RequestConditionType,
+	eventType string,
+	e controller.Explanation,
+) error {
+	// The request is kept for retries, a failed update must not leave the condition on it.
+	r = r.DeepCopy()
 	r.Status.Conditions = append(r.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
 		Status:         corev1.ConditionTrue,
-		Type:           certificatesv1.CertificateDenied,
-		Reason:         "User activation",
-		Message:        "This CSR was denied by kubectl certificate deny",
+		Type:           conditionType,
+		Reason:         e.Reason,
+		Message:        e.Message,
 		LastUpdateTime: metav1.Now(),
 	})
 
+	started := time.Now()
 	_, err := s.csr.UpdateApproval(ctx, r.Name, r, metav1.UpdateOptions{})
-	return err
+	metrics.ApprovalUpdateDuration.WithLabelValues(string(conditionType), metrics.Result(err)).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return err
+	}
+
+	s.event(ctx, r, eventType, e)
+	return nil
 }
 
-func stopWatcher(rChan chan controller.Event, stopWatchers ...func()) func() {
+// event records the decision on the request and, if it is already registered, on its node.
+func (s *k8s) event(ctx context.Context, r *certificatesv1.CertificateSigningRequest, eventType string, e controller.Explanation) {
+	s.recorder.Event(r, eventType, e.Reason, e.Message)
+
+	if e.NodeName == "" {
+		return
+	}
+	node, err := s.GetNode(ctx, e.NodeName)
+	if err != nil {
+		zap.L().Warn("get_node", zap.String("node", e.NodeName), zap.Error(err))
+		return
+	}
+	if node != nil {
+		s.recorder.Eventf(node, eventType, e.Reason, "CSR %s: %s", r.Name, e.Message)
+	}
+}
+
+// GetNode returns the node by name or nil if it is not registered.
+func (s *k8s) GetNode(ctx context.Context, name string) (*corev1.Node, error) {
+	node, err := s.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return node, err
+}
+
+func stopWatcher(stopCh chan struct{}) func() {
+	var once sync.Once
 	return func() {
-		for _, sw := range stopWatchers {
-			sw()
-		}
-		close(rChan)
+		once.Do(func() {
+			close(stopCh)
+		})
 	}
 }
@@ -0,0 +1,52 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fraima/cluster-machine-approver/internal/controller"
+)
+
+func TestApproveRetry(t *testing.T) {
+	r := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "csr-test",
+		},
+	}
+	client := fake.NewSimpleClientset(r.DeepCopy())
+
+	var conditions [][]certificatesv1.CertificateSigningRequestCondition
+	client.PrependReactor("update", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updated := action.(k8stesting.UpdateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		conditions = append(conditions, updated.Status.Conditions)
+		if len(conditions) == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "certificatesigningrequests"}, r.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	s := &k8s{
+		client:   client,
+		csr:      client.CertificatesV1().CertificateSigningRequests(),
+		recorder: record.NewFakeRecorder(10),
+	}
+	e := controller.Explanation{Reason: "InstanceVerified", Message: "IP and DNS SANs belong to instance test"}
+
+	require.Error(t, s.Approve(context.Background(), r, e))
+	require.Empty(t, r.Status.Conditions)
+	require.NoError(t, s.Approve(context.Background(), r, e))
+
+	require.Len(t, conditions, 2)
+	require.Len(t, conditions[1], 1)
+	require.Equal(t, certificatesv1.CertificateApproved, conditions[1][0].Type)
+}
@@ -0,0 +1,63 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+type LeaderElectionConfig struct {
+	Namespace string
+	LeaseName string
+	// Identity must be unique per replica, the pod name is used.
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunLeaderElection blocks until ctx is cancelled or the lease is lost.
+// onStartedLeading is called once the lease is acquired.
+// The lease is released when ctx is cancelled, so cancel it only after the leader work has stopped.
+func (s *k8s) RunLeaderElection(ctx context.Context, cfg LeaderElectionConfig, onStartedLeading func()) error {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: cfg.Namespace,
+				Name:      cfg.LeaseName,
+			},
+			Client: s.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: cfg.Identity,
+			},
+		},
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				zap.L().Info("leader_election", zap.String("result", "started leading"), zap.String("identity", cfg.Identity))
+				onStartedLeading()
+			},
+			OnStoppedLeading: func() {
+				zap.L().Info("leader_election", zap.String("result", "stopped leading"), zap.String("identity", cfg.Identity))
+			},
+			OnNewLeader: func(identity string) {
+				zap.L().Debug("leader_election", zap.String("leader", identity))
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	elector.Run(ctx)
+	return nil
+}
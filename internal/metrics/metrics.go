@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cluster_machine_approver"
+
+var (
+	RequestsSeen = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_seen_total",
+		Help:      "CSR events received from the API server by signer.",
+	}, []string{"signer"})
+
+	Decisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "Verification decisions made for CSRs by signer, decision, reason and whether they were only recorded in dry-run mode.",
+	}, []string{"signer", "decision", "reason", "dry_run"})
+
+	RetriesExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_exhausted_total",
+		Help:      "CSRs left pending after the last retry by signer and reason of the last attempt.",
+	}, []string{"signer", "reason"})
+
+	CloudRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cloud_request_duration_seconds",
+		Help:      "Latency of cloud instance lookups by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	CloudCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloud_cache_requests_total",
+		Help:      "Cloud instance lookups answered from the cache (hit) or passed to the provider (miss).",
+	}, []string{"result"})
+
+	ApprovalUpdateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "approval_update_duration_seconds",
+		Help:      "Latency of CSR approval updates by condition and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"condition", "result"})
+
+	WatchReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "csr_watch_reconnects_total",
+		Help:      "Times the CSR watch was reestablished after the API server closed it.",
+	})
+)
+
+// Result is the result label value for err.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
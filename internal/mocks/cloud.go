@@ -5,9 +5,8 @@ package mocks
 import (
 	context "context"
 
+	controller "github.com/fraima/cluster-machine-approver/internal/controller"
 	mock "github.com/stretchr/testify/mock"
-
-	net "net"
 )
 
 // Cloud is an autogenerated mock type for the cloud type
@@ -23,22 +22,22 @@ func (_m *Cloud) EXPECT() *Cloud_Expecter {
 	return &Cloud_Expecter{mock: &_m.Mock}
 }
 
-// GetInstanceAddresses provides a mock function with given fields: instanceName
-func (_m *Cloud) GetInstanceAddresses(ctx context.Context, instanceName string) ([]net.IP, error) {
-	ret := _m.Called(instanceName)
+// GetInstance provides a mock function with given fields: lookup, value
+func (_m *Cloud) GetInstance(ctx context.Context, lookup controller.Lookup, value string) (*controller.Instance, error) {
+	ret := _m.Called(lookup, value)
 
-	var r0 []net.IP
-	if rf, ok := ret.Get(0).(func( string) []net.IP); ok {
-		r0 = rf(instanceName)
+	var r0 *controller.Instance
+	if rf, ok := ret.Get(0).(func(controller.Lookup, string) *controller.Instance); ok {
+		r0 = rf(lookup, value)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]net.IP)
+			r0 = ret.Get(0).(*controller.Instance)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func( string) error); ok {
-		r1 = rf(instanceName)
+	if rf, ok := ret.Get(1).(func(controller.Lookup, string) error); ok {
+		r1 = rf(lookup, value)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -46,26 +45,27 @@ func (_m *Cloud) GetInstanceAddresses(ctx context.Context, instanceName string)
 	return r0, r1
 }
 
-// Cloud_GetInstanceAddresses_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetInstanceAddresses'
-type Cloud_GetInstanceAddresses_Call struct {
+// Cloud_GetInstance_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetInstance'
+type Cloud_GetInstance_Call struct {
 	*mock.Call
 }
 
-// GetInstanceAddresses is a helper method to define mock.On call
+// GetInstance is a helper method to define mock.On call
 //   - ctx context.Context
-//   - instanceName string
-func (_e *Cloud_Expecter) GetInstanceAddresses(ctx interface{}, instanceName interface{}) *Cloud_GetInstanceAddresses_Call {
-	return &Cloud_GetInstanceAddresses_Call{Call: _e.mock.On("GetInstanceAddresses", instanceName)}
+//   - lookup controller.Lookup
+//   - value string
+func (_e *Cloud_Expecter) GetInstance(ctx interface{}, lookup interface{}, value interface{}) *Cloud_GetInstance_Call {
+	return &Cloud_GetInstance_Call{Call: _e.mock.On("GetInstance", lookup, value)}
 }
 
-func (_c *Cloud_GetInstanceAddresses_Call) Run(run func(ctx context.Context, instanceName string)) *Cloud_GetInstanceAddresses_Call {
+func (_c *Cloud_GetInstance_Call) Run(run func(lookup controller.Lookup, value string)) *Cloud_GetInstance_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(context.Context), args[1].(string))
+		run(args[0].(controller.Lookup), args[1].(string))
 	})
 	return _c
 }
 
-func (_c *Cloud_GetInstanceAddresses_Call) Return(_a0 []net.IP, _a1 error) *Cloud_GetInstanceAddresses_Call {
+func (_c *Cloud_GetInstance_Call) Return(_a0 *controller.Instance, _a1 error) *Cloud_GetInstance_Call {
 	_c.Call.Return(_a0, _a1)
 	return _c
 }
@@ -9,6 +9,8 @@ import (
 	mock "github.com/stretchr/testify/mock"
 
 	v1 "k8s.io/api/certificates/v1"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
 // K8s is an autogenerated mock type for the k8s type
@@ -24,13 +26,52 @@ func (_m *K8s) EXPECT() *K8s_Expecter {
 	return &K8s_Expecter{mock: &_m.Mock}
 }
 
-// Approve provides a mock function with given fields: r
-func (_m *K8s) Approve(ctx context.Context, r *v1.CertificateSigningRequest) error {
-	ret := _m.Called(r)
+// Annotate provides a mock function with given fields: r, annotations
+func (_m *K8s) Annotate(ctx context.Context, r *v1.CertificateSigningRequest, annotations map[string]string) error {
+	ret := _m.Called(r, annotations)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*v1.CertificateSigningRequest, map[string]string) error); ok {
+		r0 = rf(r, annotations)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// K8s_Annotate_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Annotate'
+type K8s_Annotate_Call struct {
+	*mock.Call
+}
+
+// Annotate is a helper method to define mock.On call
+//   - ctx context.Context
+//   - r *v1.CertificateSigningRequest
+//   - annotations map[string]string
+func (_e *K8s_Expecter) Annotate(ctx interface{}, r interface{}, annotations interface{}) *K8s_Annotate_Call {
+	return &K8s_Annotate_Call{Call: _e.mock.On("Annotate", r, annotations)}
+}
+
+func (_c *K8s_Annotate_Call) Run(run func(r *v1.CertificateSigningRequest, annotations map[string]string)) *K8s_Annotate_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*v1.CertificateSigningRequest), args[1].(map[string]string))
+	})
+	return _c
+}
+
+func (_c *K8s_Annotate_Call) Return(_a0 error) *K8s_Annotate_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+// Approve provides a mock function with given fields: r, e
+func (_m *K8s) Approve(ctx context.Context, r *v1.CertificateSigningRequest, e controller.Explanation) error {
+	ret := _m.Called(r, e)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*v1.CertificateSigningRequest) error); ok {
-		r0 = rf(r)
+	if rf, ok := ret.Get(0).(func(*v1.CertificateSigningRequest, controller.Explanation) error); ok {
+		r0 = rf(r, e)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -46,13 +87,14 @@ type K8s_Approve_Call struct {
 // Approve is a helper method to define mock.On call
 //   - ctx context.Context
 //   - r *v1.CertificateSigningRequest
-func (_e *K8s_Expecter) Approve(ctx interface{}, r interface{}) *K8s_Approve_Call {
-	return &K8s_Approve_Call{Call: _e.mock.On("Approve", r)}
+//   - e controller.Explanation
+func (_e *K8s_Expecter) Approve(ctx interface{}, r interface{}, e interface{}) *K8s_Approve_Call {
+	return &K8s_Approve_Call{Call: _e.mock.On("Approve", r, e)}
 }
 
-func (_c *K8s_Approve_Call) Run(run func(r *v1.CertificateSigningRequest)) *K8s_Approve_Call {
+func (_c *K8s_Approve_Call) Run(run func(r *v1.CertificateSigningRequest, e controller.Explanation)) *K8s_Approve_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[1].(*v1.CertificateSigningRequest))
+		run(args[0].(*v1.CertificateSigningRequest), args[1].(controller.Explanation))
 	})
 	return _c
 }
@@ -107,13 +149,13 @@ func (_c *K8s_CertificateSigningRequestsChan_Call) Return(_a0 <-chan controller.
 	return _c
 }
 
-// Deny provides a mock function with given fields: r
-func (_m *K8s) Deny(ctx context.Context, r *v1.CertificateSigningRequest) error {
-	ret := _m.Called(r)
+// Deny provides a mock function with given fields: r, e
+func (_m *K8s) Deny(ctx context.Context, r *v1.CertificateSigningRequest, e controller.Explanation) error {
+	ret := _m.Called(r, e)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*v1.CertificateSigningRequest) error); ok {
-		r0 = rf(r)
+	if rf, ok := ret.Get(0).(func(*v1.CertificateSigningRequest, controller.Explanation) error); ok {
+		r0 = rf(r, e)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -129,13 +171,14 @@ type K8s_Deny_Call struct {
 // Deny is a helper method to define mock.On call
 //   - ctx context.Context
 //   - r *v1.CertificateSigningRequest
-func (_e *K8s_Expecter) Deny(ctx interface{}, r interface{}) *K8s_Deny_Call {
-	return &K8s_Deny_Call{Call: _e.mock.On("Deny", r)}
+//   - e controller.Explanation
+func (_e *K8s_Expecter) Deny(ctx interface{}, r interface{}, e interface{}) *K8s_Deny_Call {
+	return &K8s_Deny_Call{Call: _e.mock.On("Deny", r, e)}
 }
 
-func (_c *K8s_Deny_Call) Run(run func(r *v1.CertificateSigningRequest)) *K8s_Deny_Call {
+func (_c *K8s_Deny_Call) Run(run func(r *v1.CertificateSigningRequest, e controller.Explanation)) *K8s_Deny_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[1].(*v1.CertificateSigningRequest))
+		run(args[0].(*v1.CertificateSigningRequest), args[1].(controller.Explanation))
 	})
 	return _c
 }
@@ -145,6 +188,53 @@ func (_c *K8s_Deny_Call) Return(_a0 error) *K8s_Deny_Call {
 	return _c
 }
 
+// GetNode provides a mock function with given fields: name
+func (_m *K8s) GetNode(ctx context.Context, name string) (*corev1.Node, error) {
+	ret := _m.Called(name)
+
+	var r0 *corev1.Node
+	if rf, ok := ret.Get(0).(func(string) *corev1.Node); ok {
+		r0 = rf(name)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*corev1.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(name)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// K8s_GetNode_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetNode'
+type K8s_GetNode_Call struct {
+	*mock.Call
+}
+
+// GetNode is a helper method to define mock.On call
+//   - ctx context.Context
+//   - name string
+func (_e *K8s_Expecter) GetNode(ctx interface{}, name interface{}) *K8s_GetNode_Call {
+	return &K8s_GetNode_Call{Call: _e.mock.On("GetNode", name)}
+}
+
+func (_c *K8s_GetNode_Call) Run(run func(name string)) *K8s_GetNode_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *K8s_GetNode_Call) Return(_a0 *corev1.Node, _a1 error) *K8s_GetNode_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
 // Stop provides a mock function with given fields:
 func (_m *K8s) Stop() {
 	_m.Called()